@@ -0,0 +1,134 @@
+package entsquish
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build/constraint"
+	"path/filepath"
+	"strings"
+)
+
+// buildConstraint returns the normalized build constraint of file, or an
+// empty string if the file has none. Legacy "// +build" lines are only
+// consulted when there is no //go:build line, matching the go command.
+func buildConstraint(file *ast.File) (string, error) {
+	var goBuild constraint.Expr
+	var plusBuild []constraint.Expr
+
+	for _, group := range file.Comments {
+		// Build constraints must appear before the package clause
+		if group.Pos() >= file.Package {
+			break
+		}
+		for _, comment := range group.List {
+			switch {
+			case constraint.IsGoBuild(comment.Text):
+				expr, err := constraint.Parse(comment.Text)
+				if err != nil {
+					return "", fmt.Errorf("invalid build constraint %q: %w", comment.Text, err)
+				}
+				if goBuild != nil {
+					return "", fmt.Errorf("multiple //go:build lines")
+				}
+				goBuild = expr
+			case constraint.IsPlusBuild(comment.Text):
+				expr, err := constraint.Parse(comment.Text)
+				if err != nil {
+					return "", fmt.Errorf("invalid build constraint %q: %w", comment.Text, err)
+				}
+				plusBuild = append(plusBuild, expr)
+			}
+		}
+	}
+
+	if goBuild != nil {
+		return goBuild.String(), nil
+	}
+
+	if len(plusBuild) == 0 {
+		return "", nil
+	}
+
+	// Multiple +build lines are ANDed together
+	expr := plusBuild[0]
+	for _, next := range plusBuild[1:] {
+		expr = &constraint.AndExpr{X: expr, Y: next}
+	}
+	return expr.String(), nil
+}
+
+// knownOS and knownArch are the GOOS and GOARCH values the go command
+// recognizes in file name suffixes, as listed by go/build.
+var (
+	knownOS = map[string]bool{
+		"aix": true, "android": true, "darwin": true, "dragonfly": true, "freebsd": true,
+		"hurd": true, "illumos": true, "ios": true, "js": true, "linux": true, "nacl": true,
+		"netbsd": true, "openbsd": true, "plan9": true, "solaris": true, "wasip1": true,
+		"windows": true, "zos": true,
+	}
+	knownArch = map[string]bool{
+		"386": true, "amd64": true, "amd64p32": true, "arm": true, "armbe": true,
+		"arm64": true, "arm64be": true, "loong64": true, "mips": true, "mipsle": true,
+		"mips64": true, "mips64le": true, "mips64p32": true, "mips64p32le": true,
+		"ppc": true, "ppc64": true, "ppc64le": true, "riscv": true, "riscv64": true,
+		"s390": true, "s390x": true, "sparc": true, "sparc64": true, "wasm": true,
+	}
+)
+
+// fileConstraint returns the normalized constraint file is built under: its
+// build constraint lines ANDed with the constraint implied by its name, e.g.
+// "windows" for sys_windows.go.
+func fileConstraint(file *ast.File, name string) (string, error) {
+	explicit, err := buildConstraint(file)
+	if err != nil {
+		return "", err
+	}
+	implied := nameConstraint(name)
+	switch {
+	case implied == nil:
+		return explicit, nil
+	case explicit == "":
+		return implied.String(), nil
+	}
+
+	expr, err := constraint.Parse("//go:build " + explicit)
+	if err != nil {
+		return "", err
+	}
+	return (&constraint.AndExpr{X: expr, Y: implied}).String(), nil
+}
+
+// nameConstraint returns the constraint implied by the _GOOS, _GOARCH or
+// _GOOS_GOARCH suffix of a file name, or nil, following the rules of the go
+// command: the part before the first underscore never counts, nor does a
+// _test suffix.
+func nameConstraint(name string) constraint.Expr {
+	name = strings.TrimSuffix(filepath.Base(name), ".go")
+	name = strings.TrimSuffix(name, "_test")
+	i := strings.Index(name, "_")
+	if i < 0 {
+		return nil
+	}
+
+	parts := strings.Split(name[i+1:], "_")
+	n := len(parts)
+	switch {
+	case n >= 2 && knownOS[parts[n-2]] && knownArch[parts[n-1]]:
+		return &constraint.AndExpr{X: &constraint.TagExpr{Tag: parts[n-2]}, Y: &constraint.TagExpr{Tag: parts[n-1]}}
+	case knownOS[parts[n-1]] || knownArch[parts[n-1]]:
+		return &constraint.TagExpr{Tag: parts[n-1]}
+	}
+	return nil
+}
+
+// constrainedFileName returns the name of the merged file for a group of
+// files sharing a build constraint, e.g. "gen_ignore_build.go" for
+// "ignore". The "_build" suffix keeps the name from ending in a GOOS or
+// GOARCH, which would add an implicit constraint.
+func constrainedFileName(baseName, expr string) string {
+	replacer := strings.NewReplacer("!", " not ", "&&", " and ", "||", " or ")
+	fields := strings.FieldsFunc(replacer.Replace(expr), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	})
+	return baseName + "_" + strings.ToLower(strings.Join(fields, "_")) + "_build.go"
+}
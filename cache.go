@@ -0,0 +1,88 @@
+package entsquish
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// cacheVersion is the version of the cache entry format. It is part of every
+// key, so entries of an older format are never read.
+const cacheVersion = 1
+
+// cacheEntry is a merged file stored in the cache.
+type cacheEntry struct {
+	// Content is the merged file
+	Content string `json:"content"`
+
+	// Output is the manifest entry of the merged file
+	Output ManifestOutput `json:"output"`
+}
+
+// cacheKey hashes everything the merged file of pkg depends on: the
+// entsquish version, the settings that shape the output and the name and
+// content of every file.
+func (fm *FileMerger) cacheKey(pkg SquishablePackage, outputPath string) (string, error) {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "entsquish %s cache %d\n", Version(), cacheVersion)
+	fmt.Fprintf(hash, "output %s root %t strategy %q constraint %q\n",
+		filepath.Base(outputPath), fm.isRootPackage(pkg), pkg.Strategy, pkg.BuildConstraint)
+	fmt.Fprintf(hash, "conflict %s line-directives %t\n", fm.config.ConflictPolicy, fm.config.LineDirectives)
+
+	for _, fileName := range pkg.Files {
+		filePath := filepath.Join(pkg.Path, fileName)
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return "", fmt.Errorf("failed to read file %s: %w", filePath, err)
+		}
+		if err := fm.checkFileSize(filePath, int64(len(data))); err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(hash, "file %q %d\n", fileName, len(data))
+		hash.Write(data)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// cachePath returns the path of the entry stored under key.
+func (fm *FileMerger) cachePath(key string) string {
+	return filepath.Join(fm.config.CacheDir, key[:2], key+".json")
+}
+
+// loadCache returns the entry stored under key, or nil if there is none or
+// it is damaged.
+func (fm *FileMerger) loadCache(key string) *cacheEntry {
+	data, err := os.ReadFile(fm.cachePath(key))
+	if err != nil {
+		return nil
+	}
+
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || checksum([]byte(entry.Content)) != entry.Output.SHA256 {
+		if fm.verboseLogging {
+			fm.logf("entsquish: warning: ignoring damaged cache entry %s", fm.cachePath(key))
+		}
+		return nil
+	}
+	return &entry
+}
+
+// storeCache stores a merged file under key. The cache only saves time, so
+// failures are logged rather than returned.
+func (fm *FileMerger) storeCache(key string, content []byte, output ManifestOutput) {
+	data, err := json.Marshal(cacheEntry{Content: string(content), Output: output})
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(fm.cachePath(key)), 0755)
+	}
+	if err == nil {
+		err = writeFileAtomic(fm.cachePath(key), data, 0644)
+	}
+	if err != nil {
+		fm.logf("entsquish: warning: failed to cache package: %v", err)
+	}
+}
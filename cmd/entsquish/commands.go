@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/codelite7/entsquish"
+)
+
+// runSquish implements the squish command.
+func runSquish(args []string, stdout io.Writer) error {
+	flags, opts := newFlagSet("squish")
+	_ = flags.Parse(args)
+
+	report, err := squish(opts)
+	if err != nil {
+		return err
+	}
+
+	totals := report.Totals
+	fmt.Fprintf(stdout, "squished %d packages (%d cached): %d files -> %d files, %d bytes -> %d bytes\n",
+		totals.Merged, totals.Cached, totals.FilesBefore, totals.FilesAfter, totals.OriginalSize, totals.MergedSize)
+	if totals.Failed > 0 {
+		return fmt.Errorf("entsquish: %d packages failed to merge", totals.Failed)
+	}
+	return nil
+}
+
+// runDryRun implements the dry-run command.
+func runDryRun(args []string, stdout io.Writer) error {
+	flags, opts := newFlagSet("dry-run")
+	_ = flags.Parse(args)
+
+	report, err := squish(opts, entsquish.WithDryRun(true))
+	if err != nil {
+		return err
+	}
+
+	for _, result := range report.Results {
+		if !result.Success {
+			fmt.Fprintf(stdout, "fail   %s: %v\n", relPath(report, result.Package), result.Error)
+			continue
+		}
+
+		var files []string
+		for _, file := range result.OriginalFiles {
+			files = append(files, filepath.Base(file))
+		}
+		var outputs []string
+		for _, output := range result.Outputs() {
+			outputs = append(outputs, relPath(report, output))
+		}
+		fmt.Fprintf(stdout, "merge  %s -> %s\n", strings.Join(files, ", "), strings.Join(outputs, ", "))
+	}
+	for _, skipped := range report.Skipped {
+		fmt.Fprintf(stdout, "skip   %s: %s\n", relPath(report, skipped.Path), skipped.Reason)
+	}
+	return nil
+}
+
+// runDiff implements the diff command.
+func runDiff(args []string, stdout io.Writer) error {
+	flags, opts := newFlagSet("diff")
+	nameStatus := flags.Bool("name-status", false, "only list the added (A), modified (M) and deleted (D) files")
+	_ = flags.Parse(args)
+
+	if !*nameStatus {
+		_, err := squish(opts, entsquish.WithDryRun(true), entsquish.WithDiffWriter(stdout))
+		return err
+	}
+
+	report, err := squish(opts, entsquish.WithDryRun(true))
+	if err != nil {
+		return err
+	}
+
+	for _, result := range report.Results {
+		if !result.Success {
+			continue
+		}
+
+		originals := make(map[string]bool)
+		for _, file := range result.OriginalFiles {
+			originals[file] = true
+		}
+		outputs := make(map[string]bool)
+		for _, output := range result.Outputs() {
+			outputs[output] = true
+			status := "A"
+			if originals[output] {
+				status = "M"
+			}
+			fmt.Fprintf(stdout, "%s %s\n", status, relPath(report, output))
+		}
+
+		for _, file := range result.OriginalFiles {
+			if !outputs[file] {
+				fmt.Fprintf(stdout, "D %s\n", relPath(report, file))
+			}
+		}
+	}
+	return nil
+}
+
+// runStats implements the stats command.
+func runStats(args []string, stdout io.Writer) error {
+	flags, opts := newFlagSet("stats")
+	asJSON := flags.Bool("json", false, "print the full report as JSON")
+	_ = flags.Parse(args)
+
+	report, err := squish(opts, entsquish.WithDryRun(true))
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PACKAGE\tFILES\tIMPORTS DEDUPED\tORIGINAL\tMERGED\tSAVED\t")
+	for _, result := range report.Results {
+		if !result.Success {
+			continue
+		}
+		stats := result.Stats
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t\n", relPath(report, result.OutputPath),
+			stats.FilesProcessed, stats.ImportsDeduped, stats.OriginalSize, stats.MergedSize, stats.SizeReduction)
+	}
+	totals := report.Totals
+	fmt.Fprintf(w, "total\t%d\t%d\t%d\t%d\t%d\t\n",
+		totals.FilesBefore, totals.ImportsDeduped, totals.OriginalSize, totals.MergedSize, totals.SizeReduction)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "%d packages would be merged, %d failed, %d skipped\n", totals.Merged, totals.Failed, totals.Skipped)
+	return nil
+}
+
+// runRecover implements the recover command.
+func runRecover(args []string, stdout io.Writer) error {
+	flags, opts := newFlagSet("recover")
+	mode := flags.String("mode", "rollback", `"rollback" restores every package, "finish" completes the run`)
+	_ = flags.Parse(args)
+
+	var recoveryMode entsquish.RecoveryMode
+	switch *mode {
+	case "rollback":
+		recoveryMode = entsquish.RecoverRollback
+	case "finish":
+		recoveryMode = entsquish.RecoverFinish
+	default:
+		return fmt.Errorf("entsquish: unknown recovery mode %q", *mode)
+	}
+
+	ext, err := opts.extension()
+	if err != nil {
+		return err
+	}
+	return ext.Recover(recoveryMode)
+}
+
+// runUnsquish implements the unsquish command.
+func runUnsquish(args []string, stdout io.Writer) error {
+	flags, opts := newFlagSet("unsquish")
+	_ = flags.Parse(args)
+
+	ext, err := opts.extension()
+	if err != nil {
+		return err
+	}
+	return ext.Unsquish()
+}
+
+// squish runs the extension configured by opts over the target directory.
+func squish(opts *options, extra ...entsquish.ExtensionOption) (*entsquish.Report, error) {
+	ext, err := opts.extension(extra...)
+	if err != nil {
+		return nil, err
+	}
+	return ext.Squish()
+}
+
+// relPath returns path relative to the squished directory.
+func relPath(report *entsquish.Report, path string) string {
+	rel, err := filepath.Rel(report.BaseDir, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
@@ -0,0 +1,179 @@
+// Command entsquish squishes Ent generated code outside of entc, e.g. from
+// go:generate, in CI or on generated code checked in from another repository.
+//
+// Usage:
+//
+//	entsquish squish   [flags]   merge the packages of the gen tree
+//	entsquish dry-run  [flags]   list what squish would merge and skip
+//	entsquish diff     [flags]   print the unified diff squish would apply
+//	entsquish stats    [flags]   print per-package sizes before and after squishing
+//	entsquish recover  [flags]   roll back or finish an interrupted squish run
+//	entsquish unsquish [flags]   restore the original files of squished packages
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/codelite7/entsquish"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "help", "-h", "-help", "--help":
+		usage()
+		return
+	}
+
+	run, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "entsquish: unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	if err := run(os.Args[2:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// commands maps the command names to their implementation, which parses
+// args and writes its output to stdout.
+var commands = map[string]func(args []string, stdout io.Writer) error{
+	"squish":   runSquish,
+	"dry-run":  runDryRun,
+	"diff":     runDiff,
+	"stats":    runStats,
+	"recover":  runRecover,
+	"unsquish": runUnsquish,
+}
+
+// usage prints the list of commands.
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: entsquish <command> [flags]
+
+Commands:
+  squish    merge the packages of the gen tree
+  dry-run   list what squish would merge and skip
+  diff      print the unified diff squish would apply
+  stats     print per-package sizes before and after squishing
+  recover   roll back or finish an interrupted squish run
+  unsquish  restore the original files of squished packages
+
+Run "entsquish <command> -h" for the flags of a command.
+`)
+}
+
+// options holds the flags shared by every command. They map to the
+// options of entsquish.NewExtension.
+type options struct {
+	dir            string
+	verbose        bool
+	maxFileSize    int64
+	policyFile     string
+	conflict       string
+	verify         bool
+	lineDirectives bool
+	concurrency    int
+	targetSize     int64
+	targetLines    int
+	mergeTests     bool
+	cacheDir       string
+	reportPath     string
+}
+
+// newFlagSet creates the flag set of a command with the shared flags.
+func newFlagSet(name string) (*flag.FlagSet, *options) {
+	opts := &options{}
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.StringVar(&opts.dir, "dir", "ent", "target directory, relative to the current directory")
+	flags.BoolVar(&opts.verbose, "v", false, "enable verbose logging")
+	flags.Int64Var(&opts.maxFileSize, "max-file-size", 100*1024*1024, "maximum size of a file to merge, in bytes")
+	flags.StringVar(&opts.policyFile, "policy", "", "policy file (default: "+entsquish.DefaultPolicyFile+" in the module root)")
+	flags.StringVar(&opts.conflict, "conflict", "fail", `conflicting declarations: "fail", "keep-first" or "rename"`)
+	flags.BoolVar(&opts.verify, "verify", false, "type-check merged packages and revert those that break")
+	flags.BoolVar(&opts.lineDirectives, "line-directives", false, "emit //line directives pointing at the original files")
+	flags.IntVar(&opts.concurrency, "concurrency", runtime.GOMAXPROCS(0), "number of packages to merge at a time")
+	flags.Int64Var(&opts.targetSize, "target-file-size", 0, "split the root package into files of at most this many bytes")
+	flags.IntVar(&opts.targetLines, "target-file-lines", 0, "split the root package into files of at most this many lines")
+	flags.BoolVar(&opts.mergeTests, "merge-tests", false, "merge the _test.go files of every package into <name>_test.go")
+	flags.StringVar(&opts.cacheDir, "cache", "", "cache merged files in this directory and reuse them for unchanged packages")
+	flags.StringVar(&opts.reportPath, "report", "", "write a JSON report of the run to this file")
+	return flags, opts
+}
+
+// extension creates the extension configured by the flags.
+func (o *options) extension(extra ...entsquish.ExtensionOption) (*entsquish.Extension, error) {
+	conflictPolicy, err := parseConflictPolicy(o.conflict)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.absPaths(); err != nil {
+		return nil, err
+	}
+
+	opts := []entsquish.ExtensionOption{
+		entsquish.WithBaseDir(o.dir),
+		entsquish.WithVerboseLogging(o.verbose),
+		entsquish.WithMaxFileSize(o.maxFileSize),
+		entsquish.WithConflictPolicy(conflictPolicy),
+		entsquish.WithVerify(o.verify),
+		entsquish.WithLineDirectives(o.lineDirectives),
+		entsquish.WithConcurrency(o.concurrency),
+		entsquish.WithMergeTests(o.mergeTests),
+	}
+	if o.policyFile != "" {
+		opts = append(opts, entsquish.WithPolicyFile(o.policyFile))
+	}
+	if o.targetSize > 0 {
+		opts = append(opts, entsquish.WithTargetFileSize(o.targetSize))
+	}
+	if o.targetLines > 0 {
+		opts = append(opts, entsquish.WithTargetFileLines(o.targetLines))
+	}
+	if o.cacheDir != "" {
+		opts = append(opts, entsquish.WithCacheDir(o.cacheDir))
+	}
+	if o.reportPath != "" {
+		opts = append(opts, entsquish.WithReportPath(o.reportPath))
+	}
+
+	return entsquish.NewExtension(append(opts, extra...)...)
+}
+
+// absPaths makes the paths given on the command line absolute. The library
+// resolves relative paths against the module root, which is right for the
+// entc hook but not for a command run by go generate in the gen directory.
+func (o *options) absPaths() error {
+	for _, path := range []*string{&o.dir, &o.policyFile, &o.cacheDir, &o.reportPath} {
+		if *path == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*path)
+		if err != nil {
+			return fmt.Errorf("entsquish: %w", err)
+		}
+		*path = abs
+	}
+	return nil
+}
+
+// parseConflictPolicy parses the value of the -conflict flag.
+func parseConflictPolicy(value string) (entsquish.ConflictPolicy, error) {
+	for _, policy := range []entsquish.ConflictPolicy{entsquish.ConflictFail, entsquish.ConflictKeepFirst, entsquish.ConflictRename} {
+		if policy.String() == value {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("entsquish: unknown conflict policy %q", value)
+}
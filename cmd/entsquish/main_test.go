@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFile writes content to path, creating parent directories as needed.
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Failed to create directory for %s: %v", path, err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+// writeModule lays out a module whose ent directory holds a root package and
+// a user package, and changes into the ent directory as go generate would.
+func writeModule(t *testing.T) string {
+	t.Helper()
+	moduleDir := t.TempDir()
+	header := "// Code generated by ent, DO NOT EDIT.\n\n"
+	writeFile(t, filepath.Join(moduleDir, "go.mod"), "module example.com/app\n\ngo 1.25\n")
+	writeFile(t, filepath.Join(moduleDir, "main.go"), header+"package main\n\nfunc main() {}\n")
+	writeFile(t, filepath.Join(moduleDir, "helper.go"), header+"package main\n\nfunc helper() {}\n")
+
+	entDir := filepath.Join(moduleDir, "ent")
+	writeFile(t, filepath.Join(entDir, "client.go"), header+"package ent\n\ntype Client struct{}\n")
+	writeFile(t, filepath.Join(entDir, "tx.go"), header+"package ent\n\ntype Tx struct{}\n")
+	writeFile(t, filepath.Join(entDir, "user", "user.go"), header+"package user\n\nconst Label = \"user\"\n")
+	writeFile(t, filepath.Join(entDir, "user", "where.go"), header+"package user\n\nfunc ID() int { return 0 }\n")
+
+	t.Chdir(entDir)
+	return moduleDir
+}
+
+func TestFlags(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		check   func(*options) bool
+		wantErr bool
+	}{
+		{"defaults", nil, func(o *options) bool {
+			return o.dir == filepath.Join(wd, "ent") && o.conflict == "fail" && o.concurrency > 0 && o.policyFile == ""
+		}, false},
+		{"relative paths", []string{"-dir", ".", "-policy", "squish.yaml", "-cache", "cache", "-report", "out/report.json"}, func(o *options) bool {
+			return o.dir == wd && o.policyFile == filepath.Join(wd, "squish.yaml") &&
+				o.cacheDir == filepath.Join(wd, "cache") && o.reportPath == filepath.Join(wd, "out", "report.json")
+		}, false},
+		{"absolute dir", []string{"-dir", "/tmp/gen"}, func(o *options) bool { return o.dir == "/tmp/gen" }, false},
+		{"settings", []string{"-conflict", "rename", "-verify", "-merge-tests", "-target-file-lines", "500"}, func(o *options) bool {
+			return o.conflict == "rename" && o.verify && o.mergeTests && o.targetLines == 500
+		}, false},
+		{"unknown conflict policy", []string{"-conflict", "newest"}, nil, true},
+		{"invalid concurrency", []string{"-concurrency", "0"}, nil, true},
+		{"unset target file size", []string{"-target-file-size", "0"}, func(o *options) bool { return o.targetSize == 0 }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags, opts := newFlagSet("squish")
+			if err := flags.Parse(tt.args); err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+
+			_, err := opts.extension()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extension() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.check != nil && !tt.check(opts) {
+				t.Errorf("Unexpected options %+v", *opts)
+			}
+		})
+	}
+}
+
+func TestSquishRelativeDir(t *testing.T) {
+	moduleDir := writeModule(t)
+
+	var out bytes.Buffer
+	if err := commands["squish"]([]string{"-dir", ".", "-concurrency", "1"}, &out); err != nil {
+		t.Fatalf("squish failed: %v", err)
+	}
+	if !strings.HasPrefix(out.String(), "squished 2 packages (0 cached): 4 files -> 2 files") {
+		t.Errorf("Unexpected summary %q", out.String())
+	}
+
+	// The module root is not the directory the command was pointed at
+	for _, name := range []string{"main.go", "helper.go", "ent/gen.go", "ent/user/user.go"} {
+		if _, err := os.Stat(filepath.Join(moduleDir, name)); err != nil {
+			t.Errorf("Expected %s to exist: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(moduleDir, "gen.go")); !os.IsNotExist(err) {
+		t.Errorf("Expected the module root to be left alone, got %v", err)
+	}
+
+	// unsquish restores what squish merged
+	if err := commands["unsquish"]([]string{"-dir", "."}, &out); err != nil {
+		t.Fatalf("unsquish failed: %v", err)
+	}
+	for _, name := range []string{"client.go", "tx.go", "user/where.go"} {
+		if _, err := os.Stat(filepath.Join(moduleDir, "ent", name)); err != nil {
+			t.Errorf("Expected %s to be restored: %v", name, err)
+		}
+	}
+}
+
+func TestDiffNameStatus(t *testing.T) {
+	writeModule(t)
+
+	var out bytes.Buffer
+	if err := commands["diff"]([]string{"-dir", ".", "-name-status"}, &out); err != nil {
+		t.Fatalf("diff failed: %v", err)
+	}
+	expected := "A gen.go\nD client.go\nD tx.go\nM user/user.go\nD user/where.go\n"
+	if out.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func TestStats(t *testing.T) {
+	writeModule(t)
+
+	var out bytes.Buffer
+	if err := commands["stats"]([]string{"-dir", "."}, &out); err != nil {
+		t.Fatalf("stats failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 || !strings.HasPrefix(lines[0], "PACKAGE") || !strings.HasPrefix(lines[1], "gen.go") ||
+		!strings.HasPrefix(lines[2], "user/user.go") || !strings.HasPrefix(lines[3], "total") {
+		t.Errorf("Unexpected stats table:\n%s", out.String())
+	}
+	if lines[4] != "2 packages would be merged, 0 failed, 0 skipped" {
+		t.Errorf("Unexpected summary %q", lines[4])
+	}
+
+	// A dry run changes nothing
+	if _, err := os.Stat("client.go"); err != nil {
+		t.Errorf("Expected client.go to be left in place: %v", err)
+	}
+}
+
+func TestRecoverWithoutJournal(t *testing.T) {
+	writeModule(t)
+
+	var out bytes.Buffer
+	if err := commands["recover"]([]string{"-dir", ".", "-mode", "finish"}, &out); err != nil {
+		t.Errorf("recover failed: %v", err)
+	}
+	if err := commands["recover"]([]string{"-dir", ".", "-mode", "undo"}, &out); err == nil {
+		t.Error("Expected an error for an unknown recovery mode")
+	}
+}
@@ -0,0 +1,101 @@
+package entsquish
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+)
+
+// deferredOutput holds the logs and diff of a package merged concurrently
+// with others, so that they can be written in package order.
+type deferredOutput struct {
+	logs []string
+	diff bytes.Buffer
+}
+
+// flush logs the deferred messages and writes the deferred diff to w.
+func (o *deferredOutput) flush(w io.Writer) error {
+	for _, message := range o.logs {
+		log.Print(message)
+	}
+	if w == nil || o.diff.Len() == 0 {
+		return nil
+	}
+	_, err := w.Write(o.diff.Bytes())
+	return err
+}
+
+// logf logs a message, or defers it if the merger collects its output.
+func (fm *FileMerger) logf(format string, args ...any) {
+	if fm.output != nil {
+		fm.output.logs = append(fm.output.logs, fmt.Sprintf(format, args...))
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// deferOutput returns a copy of the merger that collects its logs and diff
+// in output instead of writing them.
+func (fm *FileMerger) deferOutput(output *deferredOutput) *FileMerger {
+	deferred := *fm
+	deferred.output = output
+	if fm.config.DiffWriter != nil {
+		deferred.config.DiffWriter = &output.diff
+	}
+	return &deferred
+}
+
+// packageRun is the merge of a single package within a run.
+type packageRun struct {
+	pkg    SquishablePackage
+	result *MergeResult
+	err    error
+
+	// journalErr is set if the outcome could not be recorded, which stops
+	// the run
+	journalErr error
+
+	output deferredOutput
+	done   chan struct{}
+}
+
+// merge merges the package, recording it in j unless this is a dry run.
+func (run *packageRun) merge(merger *FileMerger, j *journal) {
+	outputPath := merger.outputPath(run.pkg)
+
+	index := 0
+	if j != nil {
+		var err error
+		index, err = j.begin(run.pkg, outputPath, merger.shards(run.pkg))
+		if err != nil {
+			// The package was not touched
+			run.result = &MergeResult{Package: run.pkg.Path, OutputPath: outputPath, Error: err}
+			run.err = err
+			return
+		}
+	}
+
+	run.result, run.err = merger.MergePackage(run.pkg)
+	if j != nil {
+		run.journalErr = j.finish(index, run.err == nil)
+	}
+}
+
+// groupByDirectory returns the indexes of pkgs grouped by directory, in the
+// order the directories first appear. Packages sharing a directory share its
+// manifest and must be merged one after the other.
+func groupByDirectory(pkgs []SquishablePackage) [][]int {
+	var groups [][]int
+	groupOf := make(map[string]int)
+	for i, pkg := range pkgs {
+		group, ok := groupOf[pkg.Path]
+		if !ok {
+			group = len(groups)
+			groupOf[pkg.Path] = group
+			groups = append(groups, nil)
+		}
+		groups[group] = append(groups[group], i)
+	}
+	return groups
+}
@@ -0,0 +1,177 @@
+package entsquish
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// ConflictPolicy decides what happens when two files declare the same name
+// with different contents.
+type ConflictPolicy int
+
+const (
+	// ConflictFail aborts the merge of the package with a *ConflictError.
+	ConflictFail ConflictPolicy = iota
+
+	// ConflictKeepFirst keeps the first declaration and drops later ones.
+	ConflictKeepFirst
+
+	// ConflictRename keeps both declarations, renaming the later one after
+	// the file it came from (e.g. Validate in where.go becomes
+	// ValidateWhere) along with the references to it in that file.
+	ConflictRename
+)
+
+// String returns the string representation of ConflictPolicy.
+func (cp ConflictPolicy) String() string {
+	switch cp {
+	case ConflictFail:
+		return "fail"
+	case ConflictKeepFirst:
+		return "keep-first"
+	case ConflictRename:
+		return "rename"
+	default:
+		return "unknown"
+	}
+}
+
+// ConflictError reports two declarations of the same name whose contents
+// differ.
+type ConflictError struct {
+	// Signature identifies the declaration, e.g. "func:Validate"
+	Signature string
+
+	// First is the position of the declaration that was seen first
+	First token.Position
+
+	// Second is the position of the conflicting declaration
+	Second token.Position
+}
+
+// Error implements the error interface.
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("conflicting declarations of %s at %s and %s", e.Signature, e.First, e.Second)
+}
+
+// seenDecl is the first declaration seen for a signature.
+type seenDecl struct {
+	decl     ast.Decl
+	position token.Position
+
+	// origin is the index of the declaration's provenance entry
+	origin int
+}
+
+// sameDeclaration reports whether two declarations are structurally equal.
+// Both are printed without comments or position information, so layout
+// and documentation differences do not count.
+func (fm *FileMerger) sameDeclaration(a, b ast.Decl) bool {
+	printedA, errA := fm.normalizedDeclaration(a)
+	printedB, errB := fm.normalizedDeclaration(b)
+	return errA == nil && errB == nil && printedA == printedB
+}
+
+// normalizedDeclaration prints decl without comments and positions. The
+// printer still emits doc comments attached to the nodes, so the result is
+// parsed again without comments and printed once more.
+func (fm *FileMerger) normalizedDeclaration(decl ast.Decl) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteString("package p\n\n")
+	if err := format.Node(&buf, token.NewFileSet(), decl); err != nil {
+		return "", err
+	}
+
+	fileSet := token.NewFileSet()
+	file, err := parser.ParseFile(fileSet, "", buf.Bytes(), parser.SkipObjectResolution)
+	if err != nil {
+		return "", err
+	}
+
+	buf.Reset()
+	if err := format.Node(&buf, token.NewFileSet(), file); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// renameDeclaration renames the single name declared by decl, as well as
+// every identifier of the declaring file that the type checker resolved to
+// it. usedNames holds the names already taken in the merged package.
+func (fm *FileMerger) renameDeclaration(decl ast.Decl, fileInfo FileInfo, info *types.Info, usedNames map[string]bool) (string, error) {
+	nameIdent := fm.declaredName(decl)
+	if nameIdent == nil {
+		return "", fmt.Errorf("cannot rename declaration with multiple names")
+	}
+
+	newName := fm.renamedIdentifier(nameIdent.Name, fileInfo.Path, usedNames)
+	usedNames[newName] = true
+
+	obj := info.Defs[nameIdent]
+	if obj != nil {
+		ast.Inspect(fileInfo.AST, func(n ast.Node) bool {
+			if ident, ok := n.(*ast.Ident); ok && ident != nameIdent && info.Uses[ident] == obj {
+				ident.Name = newName
+			}
+			return true
+		})
+	}
+	nameIdent.Name = newName
+
+	return newName, nil
+}
+
+// declaredName returns the identifier declared by decl if it declares
+// exactly one name.
+func (fm *FileMerger) declaredName(decl ast.Decl) *ast.Ident {
+	switch d := decl.(type) {
+	case *ast.FuncDecl:
+		return d.Name
+	case *ast.GenDecl:
+		if len(d.Specs) != 1 {
+			return nil
+		}
+		switch s := d.Specs[0].(type) {
+		case *ast.TypeSpec:
+			return s.Name
+		case *ast.ValueSpec:
+			if len(s.Names) == 1 {
+				return s.Names[0]
+			}
+		}
+	}
+	return nil
+}
+
+// renamedIdentifier derives a new name from name and the base name of the
+// file the declaration came from, e.g. Validate and user_query.go give
+// ValidateUserQuery.
+func (fm *FileMerger) renamedIdentifier(name, filePath string, usedNames map[string]bool) string {
+	base := strings.TrimSuffix(filepath.Base(filePath), ".go")
+
+	var suffix strings.Builder
+	for _, part := range strings.FieldsFunc(base, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		runes := []rune(part)
+		runes[0] = unicode.ToUpper(runes[0])
+		suffix.WriteString(string(runes))
+	}
+	if suffix.Len() == 0 {
+		suffix.WriteString("Dup")
+	}
+
+	candidate := name + suffix.String()
+	for counter := 2; usedNames[candidate]; counter++ {
+		candidate = fmt.Sprintf("%s%s%d", name, suffix.String(), counter)
+	}
+	return candidate
+}
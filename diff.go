@@ -0,0 +1,224 @@
+package entsquish
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines around each hunk.
+const diffContext = 3
+
+// diffOp is the kind of a line in an edit script.
+type diffOp byte
+
+const (
+	diffEqual  diffOp = ' '
+	diffDelete diffOp = '-'
+	diffInsert diffOp = '+'
+)
+
+// diffEdit is a single line of an edit script.
+type diffEdit struct {
+	op   diffOp
+	line string
+}
+
+// unifiedDiff returns the unified diff turning oldText into newText, with
+// oldName and newName in its header. It is empty if the texts are equal.
+func unifiedDiff(oldName, newName string, oldText, newText []byte) string {
+	if bytes.Equal(oldText, newText) {
+		return ""
+	}
+
+	edits := diffLines(splitLines(oldText), splitLines(newText))
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", oldName, newName)
+	writeHunks(&buf, edits)
+	return buf.String()
+}
+
+// splitLines splits text into lines, keeping the line endings.
+func splitLines(text []byte) []string {
+	var lines []string
+	for len(text) > 0 {
+		i := bytes.IndexByte(text, '\n')
+		if i < 0 {
+			lines = append(lines, string(text))
+			break
+		}
+		lines = append(lines, string(text[:i+1]))
+		text = text[i+1:]
+	}
+	return lines
+}
+
+// diffLines computes a shortest edit script from a to b. Common prefixes and
+// suffixes are stripped before running Myers' algorithm on the rest.
+func diffLines(a, b []string) []diffEdit {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var edits []diffEdit
+	for _, line := range a[:prefix] {
+		edits = append(edits, diffEdit{diffEqual, line})
+	}
+	edits = append(edits, myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		edits = append(edits, diffEdit{diffEqual, line})
+	}
+	return edits
+}
+
+// myersDiff implements the O((N+M)D) algorithm from "An O(ND) Difference
+// Algorithm and Its Variations" (Myers, 1986).
+func myersDiff(a, b []string) []diffEdit {
+	var edits []diffEdit
+	if len(a) == 0 || len(b) == 0 {
+		for _, line := range a {
+			edits = append(edits, diffEdit{diffDelete, line})
+		}
+		for _, line := range b {
+			edits = append(edits, diffEdit{diffInsert, line})
+		}
+		return edits
+	}
+
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+
+	// trace[d] holds v[-d..d] as it was before round d
+	var trace [][]int
+	for d := 0; ; d++ {
+		trace = append(trace, append([]int{}, v[offset-d:offset+d+1]...))
+
+		found := false
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+		if found {
+			break
+		}
+	}
+
+	// Walk the trace backwards to recover the edits
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		prev := trace[d]
+		at := func(k int) int { return prev[k+d] }
+
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := 0
+		if d > 0 {
+			prevX = at(prevK)
+		}
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			edits = append(edits, diffEdit{diffEqual, a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				edits = append(edits, diffEdit{diffInsert, b[y-1]})
+				y--
+			} else {
+				edits = append(edits, diffEdit{diffDelete, a[x-1]})
+				x--
+			}
+		}
+	}
+
+	// The edits were collected from the end
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+// writeHunks writes the edit script as unified diff hunks.
+func writeHunks(buf *strings.Builder, edits []diffEdit) {
+	// oldLine[i] and newLine[i] count the lines before edit i
+	oldLine := make([]int, len(edits)+1)
+	newLine := make([]int, len(edits)+1)
+	for i, edit := range edits {
+		oldLine[i+1], newLine[i+1] = oldLine[i], newLine[i]
+		if edit.op != diffInsert {
+			oldLine[i+1]++
+		}
+		if edit.op != diffDelete {
+			newLine[i+1]++
+		}
+	}
+
+	for i := 0; i < len(edits); {
+		if edits[i].op == diffEqual {
+			i++
+			continue
+		}
+
+		// Extend the hunk over changes separated by little context
+		start := max(i-diffContext, 0)
+		end := i + 1
+		for j := end; j < len(edits) && j <= end+2*diffContext; j++ {
+			if edits[j].op != diffEqual {
+				end = j + 1
+			}
+		}
+		end = min(end+diffContext, len(edits))
+
+		oldCount, newCount := oldLine[end]-oldLine[start], newLine[end]-newLine[start]
+		fmt.Fprintf(buf, "@@ -%s +%s @@\n", hunkRange(oldLine[start], oldCount), hunkRange(newLine[start], newCount))
+		for _, edit := range edits[start:end] {
+			buf.WriteByte(byte(edit.op))
+			buf.WriteString(edit.line)
+			if !strings.HasSuffix(edit.line, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		i = end
+	}
+}
+
+// hunkRange formats the start and length of a hunk side. An empty side
+// refers to the line before it.
+func hunkRange(before, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", before+1)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
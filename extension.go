@@ -1,9 +1,15 @@
 package entsquish
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"entgo.io/ent/entc"
 	"entgo.io/ent/entc/gen"
@@ -16,6 +22,19 @@ type (
 		verboseLogging bool
 		dryRun         bool
 		maxFileSize    int64
+		baseDir        string
+		policyFile     string
+		policy         Policy
+		conflictPolicy ConflictPolicy
+		verify         bool
+		lineDirectives bool
+		concurrency    int
+		targetSize     int64
+		targetLines    int
+		mergeTests     bool
+		cacheDir       string
+		reportPath     string
+		diffWriter     io.Writer
 	}
 
 	// ExtensionOption allows for managing the Extension configuration
@@ -29,6 +48,7 @@ func NewExtension(opts ...ExtensionOption) (*Extension, error) {
 		verboseLogging: false,             // Default to quiet operation
 		dryRun:         false,             // Default to actual operation
 		maxFileSize:    100 * 1024 * 1024, // Default to 100MB limit
+		concurrency:    1,                 // Default to one package at a time
 	}
 
 	for _, opt := range opts {
@@ -64,6 +84,13 @@ func (e *Extension) Hooks() []gen.Hook {
 					log.Printf("entsquish: starting file squishing process")
 				}
 
+				// ent writes every file again, so merged files that come out
+				// the same get their modification time back afterwards
+				var previous []mergedFileTime
+				if baseDir, err := e.resolveBaseDir(g); err == nil && !e.dryRun {
+					previous = mergedFileTimes(baseDir)
+				}
+
 				// Let normal generation complete first
 				err := next.Generate(g)
 				if err != nil {
@@ -71,7 +98,13 @@ func (e *Extension) Hooks() []gen.Hook {
 				}
 
 				// Then squish the files
-				return e.squishFiles(g)
+				if err := e.squishFiles(g); err != nil {
+					return err
+				}
+				if err := restoreModTimes(previous); err != nil {
+					return fmt.Errorf("entsquish: %w", err)
+				}
+				return nil
 			})
 		},
 	}
@@ -83,48 +116,376 @@ func (e *Extension) squishFiles(g *gen.Graph) error {
 		log.Printf("entsquish: analyzing %d nodes for squishing opportunities", len(g.Nodes))
 	}
 
-	detector := NewPackageDetector(e.verboseLogging, e.maxFileSize)
-	merger := NewFileMerger(e.verboseLogging, e.dryRun, e.maxFileSize)
+	baseDir, err := e.resolveBaseDir(g)
+	if err != nil {
+		return fmt.Errorf("entsquish: failed to resolve target directory: %w", err)
+	}
+
+	if e.verboseLogging {
+		log.Printf("entsquish: using target directory %s", baseDir)
+	}
+
+	// Root files are named after the package of their entity
+	var entities []string
+	for _, node := range g.Nodes {
+		entities = append(entities, node.PackageDir())
+	}
+
+	_, err = e.squish(baseDir, entities, generatedFiles(g))
+	return err
+}
+
+// generatedFiles returns the files ent writes for g, relative to its target.
+// Skip conditions of graph templates are ignored, listing a file that was
+// not written does no harm.
+func generatedFiles(g *gen.Graph) []string {
+	var files []string
+	for _, node := range g.Nodes {
+		for _, tmpl := range gen.Templates {
+			if tmpl.Cond == nil || tmpl.Cond(node) {
+				files = append(files, filepath.ToSlash(tmpl.Format(node)))
+			}
+		}
+	}
+	for _, tmpl := range gen.GraphTemplates {
+		files = append(files, filepath.ToSlash(tmpl.Format))
+	}
+	for _, feature := range g.Features {
+		for _, tmpl := range feature.GraphTemplates {
+			files = append(files, filepath.ToSlash(tmpl.Format))
+		}
+	}
+	return files
+}
+
+// Squish squishes the directory set with WithBaseDir outside of entc, e.g.
+// generated code checked in from another repository. It honors the same
+// options as the entc hook and returns the report of the run.
+func (e *Extension) Squish() (*Report, error) {
+	baseDir, err := e.resolveBaseDir(nil)
+	if err != nil {
+		return nil, fmt.Errorf("entsquish: failed to resolve target directory: %w", err)
+	}
+	return e.squish(baseDir, nil, nil)
+}
+
+// squish runs the squishing process over baseDir and writes the report if
+// WithReportPath was given. entities are the entities of the graph and
+// generated the files it wrote, if known.
+func (e *Extension) squish(baseDir string, entities, generated []string) (*Report, error) {
+	config, err := e.squishingConfig(baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("entsquish: %w", err)
+	}
+	config.Entities = entities
+	config.GeneratedFiles = generated
+
+	report, err := squishPackages(config)
+	if report != nil && e.reportPath != "" {
+		reportPath, resolveErr := ResolveBaseDir(e.reportPath)
+		if resolveErr == nil {
+			resolveErr = report.WriteFile(reportPath)
+		}
+		if resolveErr != nil {
+			return report, errors.Join(err, fmt.Errorf("entsquish: %w", resolveErr))
+		}
+		if e.verboseLogging {
+			log.Printf("entsquish: wrote report to %s", reportPath)
+		}
+	}
+	return report, err
+}
+
+// squishPackages detects and merges the packages under config.BaseDir. Unless
+// this is a dry run, progress is recorded in a journal so that an
+// interrupted run can be recovered with Recover. The returned report covers
+// the packages processed before an error, if any.
+func squishPackages(config SquishingConfig) (*Report, error) {
+	detector := NewPackageDetectorFromConfig(config)
+	merger := NewFileMergerFromConfig(config)
+	report := &Report{BaseDir: merger.config.BaseDir, DryRun: config.DryRun}
 
 	// Detect packages that can be safely squished
 	squishablePackages, err := detector.FindSquishablePackages()
 	if err != nil {
-		return fmt.Errorf("entsquish: failed to detect squishable packages: %w", err)
+		return nil, fmt.Errorf("entsquish: failed to detect squishable packages: %w", err)
 	}
+	report.addSkipped(detector.Skipped())
 
-	if e.verboseLogging {
+	// Merged files the generator replaced would break the package
+	if !config.DryRun {
+		for _, dir := range detector.stale() {
+			removed, err := removeStaleOutputs(dir)
+			if err != nil {
+				return report, fmt.Errorf("entsquish: %w", err)
+			}
+			if config.VerboseLogging && len(removed) > 0 {
+				log.Printf("entsquish: removed stale merged files of %s: %s", dir, strings.Join(removed, ", "))
+			}
+		}
+	}
+
+	if config.VerboseLogging {
 		log.Printf("entsquish: found %d squishable packages", len(squishablePackages))
 	}
 
 	if len(squishablePackages) == 0 {
-		if e.verboseLogging {
+		if config.VerboseLogging {
 			log.Printf("entsquish: no packages found for squishing")
 		}
-		return nil
+		return report, nil
 	}
 
-	// Merge files in each squishable package
-	successCount := 0
-	for _, pkg := range squishablePackages {
-		err := merger.MergePackage(pkg)
+	var j *journal
+	if !config.DryRun {
+		j, err = createJournal(merger.config.BaseDir)
 		if err != nil {
-			log.Printf("entsquish: warning: failed to merge package %s: %v", pkg.Path, err)
-			continue // Continue with other packages on error
+			return report, fmt.Errorf("entsquish: %w", err)
 		}
-		successCount++
 	}
 
-	if e.verboseLogging {
-		log.Printf("entsquish: successfully squished %d/%d packages", successCount, len(squishablePackages))
+	// Merge the packages on a pool of workers. Results, logs and diffs are
+	// collected in package order, so the output does not depend on timing.
+	concurrency := max(config.Concurrency, 1)
+	runs := make([]*packageRun, len(squishablePackages))
+	for i, pkg := range squishablePackages {
+		runs[i] = &packageRun{pkg: pkg, done: make(chan struct{})}
+	}
+
+	var stopped atomic.Bool
+	work := make(chan []int)
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for indexes := range work {
+				for _, i := range indexes {
+					if !stopped.Load() {
+						packageMerger := merger
+						if concurrency > 1 {
+							packageMerger = merger.deferOutput(&runs[i].output)
+						}
+						runs[i].merge(packageMerger, j)
+					}
+					close(runs[i].done)
+				}
+			}
+		}()
 	}
+	go func() {
+		for _, indexes := range groupByDirectory(squishablePackages) {
+			work <- indexes
+		}
+		close(work)
+	}()
+
+	var runErr error
+	for _, run := range runs {
+		<-run.done
+		if runErr != nil {
+			continue
+		}
 
-	if e.dryRun {
+		if err := run.output.flush(config.DiffWriter); err != nil {
+			runErr = fmt.Errorf("entsquish: failed to write diff: %w", err)
+			stopped.Store(true)
+			continue
+		}
+		report.addResult(run.result)
+		if run.journalErr != nil {
+			runErr = fmt.Errorf("entsquish: failed to update journal: %w", run.journalErr)
+			stopped.Store(true)
+			continue
+		}
+		if run.err != nil {
+			log.Printf("entsquish: warning: failed to merge package %s: %v", run.pkg.Path, run.err)
+		}
+	}
+	wg.Wait()
+	if runErr != nil {
+		return report, runErr
+	}
+
+	if j != nil {
+		if err := j.remove(); err != nil {
+			return report, fmt.Errorf("entsquish: %w", err)
+		}
+	}
+
+	if config.VerboseLogging {
+		log.Printf("entsquish: successfully squished %d/%d packages", report.Totals.Merged, len(squishablePackages))
+	}
+
+	if config.DryRun {
 		log.Printf("entsquish: DRY RUN completed - no files were actually modified")
 	}
 
+	return report, nil
+}
+
+// Recover rolls back or finishes an interrupted squish run of the directory
+// set with WithBaseDir, using the options of the extension. See Recover.
+func (e *Extension) Recover(mode RecoveryMode) error {
+	baseDir, err := e.resolveBaseDir(nil)
+	if err != nil {
+		return fmt.Errorf("entsquish: failed to resolve target directory: %w", err)
+	}
+
+	config, err := e.squishingConfig(baseDir)
+	if err != nil {
+		return fmt.Errorf("entsquish: %w", err)
+	}
+
+	if err := Recover(config, mode); err != nil {
+		return fmt.Errorf("entsquish: recovery failed: %w", err)
+	}
 	return nil
 }
 
+// Unsquish restores the original files of every squished package under the
+// directory set with WithBaseDir. See Unsquish. A directory that fails does
+// not stop the others, their errors are returned together.
+func (e *Extension) Unsquish() error {
+	baseDir, err := e.resolveBaseDir(nil)
+	if err != nil {
+		return fmt.Errorf("entsquish: failed to resolve target directory: %w", err)
+	}
+
+	dirs, err := manifestDirs(baseDir)
+	if err != nil {
+		return fmt.Errorf("entsquish: %w", err)
+	}
+
+	var errs []error
+	for _, dir := range dirs {
+		if err := Unsquish(dir); err != nil {
+			errs = append(errs, fmt.Errorf("entsquish: %w", err))
+			continue
+		}
+		if e.verboseLogging {
+			log.Printf("entsquish: unsquished package %s", dir)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// squishingConfig builds the SquishingConfig shared by the detector and the
+// merger for a single run.
+func (e *Extension) squishingConfig(baseDir string) (SquishingConfig, error) {
+	policy, err := e.resolvePolicy()
+	if err != nil {
+		return SquishingConfig{}, err
+	}
+
+	config := DefaultSquishingConfig()
+	config.BaseDir = baseDir
+	config.DryRun = e.dryRun
+	config.VerboseLogging = e.verboseLogging
+	config.MaxFileSize = e.maxFileSize
+	config.Policy = policy
+	config.ConflictPolicy = e.conflictPolicy
+	config.Verify = e.verify
+	config.LineDirectives = e.lineDirectives
+	config.Concurrency = e.concurrency
+	config.TargetFileSize = e.targetSize
+	config.TargetFileLines = e.targetLines
+	config.MergeTests = e.mergeTests
+	if e.cacheDir != "" {
+		if config.CacheDir, err = ResolveBaseDir(e.cacheDir); err != nil {
+			return SquishingConfig{}, fmt.Errorf("failed to resolve cache directory: %w", err)
+		}
+	}
+	config.DiffWriter = e.diffWriter
+	return config, nil
+}
+
+// resolvePolicy combines the default policy, the policy file and the
+// programmatic options, in increasing order of precedence. Without
+// WithPolicyFile, a DefaultPolicyFile in the module root is used if present.
+func (e *Extension) resolvePolicy() (Policy, error) {
+	policyFile := e.policyFile
+	if policyFile == "" {
+		candidate, err := ResolveBaseDir(DefaultPolicyFile)
+		if err != nil {
+			return Policy{}, err
+		}
+		if _, err := os.Stat(candidate); err == nil {
+			policyFile = candidate
+		}
+	}
+
+	var policy Policy
+	if policyFile != "" {
+		path, err := ResolveBaseDir(policyFile)
+		if err != nil {
+			return Policy{}, err
+		}
+		policy, err = LoadPolicy(path)
+		if err != nil {
+			return Policy{}, err
+		}
+		if e.verboseLogging {
+			log.Printf("entsquish: loaded policy from %s", path)
+		}
+	}
+
+	return policy.Merge(e.policy).WithDefaults(), nil
+}
+
+// resolveBaseDir returns the absolute directory to squish. WithBaseDir takes
+// precedence over gen.Config.Target, and relative paths are resolved against
+// the module root. A relative gen.Config.Target is resolved against the
+// current directory, where ent writes it.
+func (e *Extension) resolveBaseDir(g *gen.Graph) (string, error) {
+	if e.baseDir != "" {
+		return ResolveBaseDir(e.baseDir)
+	}
+	if g == nil || g.Config == nil || g.Config.Target == "" {
+		return "", fmt.Errorf("gen.Config.Target is empty and no base directory was configured")
+	}
+	dir, err := filepath.Abs(g.Config.Target)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve gen.Config.Target: %w", err)
+	}
+	return dir, nil
+}
+
+// ResolveBaseDir makes dir absolute. Relative paths are joined with the root
+// of the enclosing Go module (the nearest directory holding a go.mod), falling
+// back to the current working directory outside of a module.
+func ResolveBaseDir(dir string) (string, error) {
+	if filepath.IsAbs(dir) {
+		return filepath.Clean(dir), nil
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("failed to get working directory: %w", err)
+	}
+
+	root, ok := findModuleRoot(wd)
+	if !ok {
+		root = wd
+	}
+
+	return filepath.Join(root, dir), nil
+}
+
+// findModuleRoot walks up from dir looking for a go.mod file.
+func findModuleRoot(dir string) (string, bool) {
+	for {
+		if info, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil && !info.IsDir() {
+			return dir, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
 // WithVerboseLogging enables or disables verbose logging.
 func WithVerboseLogging(enabled bool) ExtensionOption {
 	return func(e *Extension) error {
@@ -148,3 +509,181 @@ func WithMaxFileSize(size int64) ExtensionOption {
 		return nil
 	}
 }
+
+// WithBaseDir overrides the directory to squish, which otherwise defaults to
+// gen.Config.Target. Relative paths are resolved against the module root.
+func WithBaseDir(dir string) ExtensionOption {
+	return func(e *Extension) error {
+		if dir == "" {
+			return fmt.Errorf("entsquish: base directory must not be empty")
+		}
+		e.baseDir = dir
+		return nil
+	}
+}
+
+// WithPolicy adds include/exclude globs and per-package rules. Rules given
+// here take precedence over the policy file.
+func WithPolicy(policy Policy) ExtensionOption {
+	return func(e *Extension) error {
+		if err := policy.Validate(); err != nil {
+			return fmt.Errorf("entsquish: invalid policy: %w", err)
+		}
+		e.policy = e.policy.Merge(policy)
+		return nil
+	}
+}
+
+// WithPolicyFile loads the policy from the given YAML file instead of
+// looking for DefaultPolicyFile in the module root.
+func WithPolicyFile(path string) ExtensionOption {
+	return func(e *Extension) error {
+		if path == "" {
+			return fmt.Errorf("entsquish: policy file must not be empty")
+		}
+		e.policyFile = path
+		return nil
+	}
+}
+
+// WithPackageFilter registers a filter that decides whether a detected
+// package is squished. All filters must return true for a package to be
+// squished.
+func WithPackageFilter(filter func(SquishablePackage) bool) ExtensionOption {
+	return func(e *Extension) error {
+		if filter == nil {
+			return fmt.Errorf("entsquish: package filter must not be nil")
+		}
+		e.policy = e.policy.WithFilter(filter)
+		return nil
+	}
+}
+
+// WithConflictPolicy sets how duplicate declarations with different
+// contents are handled. The default, ConflictFail, leaves the package
+// untouched and reports a *ConflictError.
+func WithConflictPolicy(policy ConflictPolicy) ExtensionOption {
+	return func(e *Extension) error {
+		switch policy {
+		case ConflictFail, ConflictKeepFirst, ConflictRename:
+			e.conflictPolicy = policy
+			return nil
+		default:
+			return fmt.Errorf("entsquish: unknown conflict policy %d", policy)
+		}
+	}
+}
+
+// WithVerify enables type-checking every package after it is merged. A
+// package that gains type errors in the merge is reverted and reported with
+// a *VerifyError. Verification loads imports from source and slows the run
+// down noticeably on large schemas.
+func WithVerify(enabled bool) ExtensionOption {
+	return func(e *Extension) error {
+		e.verify = enabled
+		return nil
+	}
+}
+
+// WithLineDirectives emits a //line directive above every merged
+// declaration, so that compiler errors, stack traces and coverage refer to
+// the original file and line instead of the merged file.
+func WithLineDirectives(enabled bool) ExtensionOption {
+	return func(e *Extension) error {
+		e.lineDirectives = enabled
+		return nil
+	}
+}
+
+// WithConcurrency merges packages and parses their files on up to n
+// goroutines. A typical value is runtime.GOMAXPROCS(0); the output is the
+// same as with n = 1. The library default is 1, while the entsquish command
+// defaults to runtime.GOMAXPROCS(0).
+func WithConcurrency(n int) ExtensionOption {
+	return func(e *Extension) error {
+		if n < 1 {
+			return fmt.Errorf("entsquish: concurrency must be at least 1, got %d", n)
+		}
+		e.concurrency = n
+		return nil
+	}
+}
+
+// WithTargetFileSize splits the root package into shards of at most bytes
+// each, gen_1.go to gen_N.go, instead of a single gen.go. A type stays in the
+// same shard as its methods, and a declaration larger than the budget gets
+// a shard of its own. Shards are cut at the same declarations from one run
+// to the next, so a regeneration mostly changes the shards it touches.
+func WithTargetFileSize(bytes int64) ExtensionOption {
+	return func(e *Extension) error {
+		if bytes < 1 {
+			return fmt.Errorf("entsquish: target file size must be positive, got %d", bytes)
+		}
+		e.targetSize = bytes
+		return nil
+	}
+}
+
+// WithTargetFileLines is like WithTargetFileSize with a budget of lines.
+// Both budgets can be set, in which case shards stay within both.
+func WithTargetFileLines(lines int) ExtensionOption {
+	return func(e *Extension) error {
+		if lines < 1 {
+			return fmt.Errorf("entsquish: target file lines must be positive, got %d", lines)
+		}
+		e.targetLines = lines
+		return nil
+	}
+}
+
+// WithMergeTests merges the _test.go files of every package into
+// <name>_test.go, e.g. user/user_test.go, and those of its external test
+// package (package user_test) into <name>_external_test.go. Without it, test
+// files are never merged.
+func WithMergeTests(enabled bool) ExtensionOption {
+	return func(e *Extension) error {
+		e.mergeTests = enabled
+		return nil
+	}
+}
+
+// WithCacheDir caches merged files in dir, keyed by a hash of the original
+// files, the settings and the entsquish version. Packages whose files did not
+// change since an earlier run are written from the cache without being
+// parsed or merged again. Relative paths are resolved against the module
+// root. Entries are never evicted; remove the directory to clear the cache.
+func WithCacheDir(dir string) ExtensionOption {
+	return func(e *Extension) error {
+		if dir == "" {
+			return fmt.Errorf("entsquish: cache directory must not be empty")
+		}
+		e.cacheDir = dir
+		return nil
+	}
+}
+
+// WithReportPath writes a JSON Report of every run to path, covering the
+// merged, failed and skipped packages along with size totals. Relative paths
+// are resolved against the module root.
+func WithReportPath(path string) ExtensionOption {
+	return func(e *Extension) error {
+		if path == "" {
+			return fmt.Errorf("entsquish: report path must not be empty")
+		}
+		e.reportPath = path
+		return nil
+	}
+}
+
+// WithDiffWriter writes a unified diff of every package to w during a dry
+// run, showing the merged file next to the files it replaces, including the
+// rewritten import aliases. It has no effect without WithDryRun.
+func WithDiffWriter(w io.Writer) ExtensionOption {
+	return func(e *Extension) error {
+		if w == nil {
+			return fmt.Errorf("entsquish: diff writer must not be nil")
+		}
+		e.diffWriter = w
+		return nil
+	}
+}
@@ -1,16 +1,22 @@
 package entsquish
 
 import (
+	"bytes"
 	"fmt"
 	"go/ast"
+	"go/build/constraint"
 	"go/format"
 	"go/parser"
+	"go/printer"
 	"go/token"
-	"log"
+	"go/types"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 // FileMerger handles the merging of Go files within a package.
@@ -18,168 +24,455 @@ type FileMerger struct {
 	verboseLogging bool
 	dryRun         bool
 	config         SquishingConfig
+
+	// output collects the logs and diff of a package merged concurrently
+	// with others, see deferOutput
+	output *deferredOutput
+
+	// locks keep verification from type-checking packages that are
+	// half-written, see treeLocks
+	locks *treeLocks
+
+	// imports type-checks the imports of verification once per run for
+	// packages outside the gen tree, see sourceImporter
+	imports *sourceImporter
+
+	// slots bounds the packages merged and files parsed at a time to
+	// Concurrency. It is shared by the copies made by deferOutput.
+	slots chan struct{}
 }
 
 // NewFileMerger creates a new file merger.
 func NewFileMerger(verboseLogging, dryRun bool, maxFileSize int64) *FileMerger {
 	config := DefaultSquishingConfig()
+	config.VerboseLogging = verboseLogging
+	config.DryRun = dryRun
 	config.MaxFileSize = maxFileSize
+	return NewFileMergerFromConfig(config)
+}
+
+// NewFileMergerFromConfig creates a new file merger for packages under
+// config.BaseDir.
+func NewFileMergerFromConfig(config SquishingConfig) *FileMerger {
+	config.BaseDir = filepath.Clean(config.BaseDir)
 	return &FileMerger{
-		verboseLogging: verboseLogging,
-		dryRun:         dryRun,
+		verboseLogging: config.VerboseLogging,
+		dryRun:         config.DryRun,
 		config:         config,
+		locks:          newTreeLocks(config.BaseDir),
+		imports:        newSourceImporter(config.BaseDir),
+		slots:          make(chan struct{}, max(config.Concurrency, 1)),
 	}
 }
 
-// MergePackage merges all files in the given package.
-func (fm *FileMerger) MergePackage(pkg SquishablePackage) error {
-	if fm.verboseLogging {
-		log.Printf("entsquish: merging package %s with %d files", pkg.Path, len(pkg.Files))
+// MergePackage merges all files in the given package. The result is
+// returned even when the merge fails, with Error set to the returned error.
+func (fm *FileMerger) MergePackage(pkg SquishablePackage) (*MergeResult, error) {
+	result := &MergeResult{
+		Package:    pkg.Path,
+		OutputPath: fm.outputPath(pkg),
+	}
+	for _, fileName := range pkg.Files {
+		result.OriginalFiles = append(result.OriginalFiles, filepath.Join(pkg.Path, fileName))
 	}
 
-	// Create a shared FileSet for all files in this package
-	sharedFileSet := token.NewFileSet()
+	// Every package being merged holds a slot, see parseFiles
+	fm.slots <- struct{}{}
+	defer func() { <-fm.slots }()
 
-	// Parse all files in the package using the shared FileSet
-	fileInfos, err := fm.parseFiles(pkg, sharedFileSet)
-	if err != nil {
-		return fmt.Errorf("failed to parse files in package %s: %w", pkg.Path, err)
+	if err := fm.mergePackage(pkg, result); err != nil {
+		result.Error = err
+		return result, err
 	}
 
-	// For entity packages, expect exactly 2 files
-	// For root packages, expect at least 2 files
-	isRootPackage := pkg.EntityName == "gen"
-	if !isRootPackage && len(fileInfos) != 2 {
-		return fmt.Errorf("expected 2 files in entity package %s, got %d", pkg.Path, len(fileInfos))
+	result.Success = true
+	return result, nil
+}
+
+// mergePackage does the work of MergePackage, filling in the stats of result.
+func (fm *FileMerger) mergePackage(pkg SquishablePackage, result *MergeResult) error {
+	if fm.verboseLogging {
+		fm.logf("entsquish: merging package %s with %d files", pkg.Path, len(pkg.Files))
 	}
-	if isRootPackage && len(fileInfos) < 2 {
-		return fmt.Errorf("expected at least 2 files in root package %s, got %d", pkg.Path, len(fileInfos))
+
+	outputPath := result.OutputPath
+
+	// Reuse the merge of identical inputs from the cache
+	var cacheKey string
+	var content []byte
+	var provenance *ManifestOutput
+	var err error
+	if fm.config.CacheDir != "" {
+		cacheKey, err = fm.cacheKey(pkg, outputPath)
+		if err != nil {
+			return fmt.Errorf("failed to hash files in package %s: %w", pkg.Path, err)
+		}
+		if entry := fm.loadCache(cacheKey); entry != nil {
+			if fm.verboseLogging {
+				fm.logf("entsquish: package %s is unchanged, using the cached merge", pkg.Path)
+			}
+			content, provenance = []byte(entry.Content), &entry.Output
+			result.Stats = entry.Output.Stats
+			result.Cached = true
+		}
 	}
 
-	// Merge the files
-	mergedAST, err := fm.MergeASTs(fileInfos)
-	if err != nil {
-		return fmt.Errorf("failed to merge ASTs for package %s: %w", pkg.Path, err)
+	if !result.Cached {
+		content, provenance, err = fm.mergeFiles(pkg, result)
+		if err != nil {
+			return err
+		}
 	}
 
-	// Generate output file path
-	var outputPath string
-	if isRootPackage {
-		// For root package, use gen.go directly in the directory
-		outputPath = filepath.Join(pkg.Path, "gen.go")
-	} else {
-		// For entity packages, use entity name
-		outputPath = filepath.Join(pkg.Path, pkg.EntityName+".go")
+	// Record where each declaration came from, for Unsquish
+	provenance.Output = filepath.Base(outputPath)
+	provenance.SHA256 = checksum(content)
+	provenance.Entsquish = Version()
+	provenance.Options = ManifestOptions{
+		Strategy:       pkg.Strategy,
+		ConflictPolicy: fm.config.ConflictPolicy.String(),
+		Verify:         fm.config.Verify,
+		MaxFileSize:    fm.config.MaxFileSize,
+		LineDirectives: fm.config.LineDirectives,
+	}
+	provenance.Stats = result.Stats
+
+	// The merge is cached once it is in place, so that a merge verification
+	// reverts is never reused
+	storeCache := cacheKey != "" && !result.Cached && !fm.dryRun
+	var cached ManifestOutput
+	if storeCache {
+		cached = *provenance
+	}
+
+	// Split the root package into files of bounded size
+	outputPaths, contents := []string{outputPath}, [][]byte{content}
+	if fm.shards(pkg) {
+		outputPaths, contents, err = fm.shardFile(outputPath, content, provenance)
+		if err != nil {
+			return fmt.Errorf("failed to shard merged file for package %s: %w", pkg.Path, err)
+		}
+		if len(provenance.Shards) > 0 {
+			provenance.Options.TargetFileSize = fm.config.TargetFileSize
+			provenance.Options.TargetFileLines = fm.config.TargetFileLines
+			result.OutputPath, result.Shards = outputPaths[0], outputPaths
+			fm.fillShardStats(&result.Stats, contents)
+			provenance.Stats = result.Stats
+		}
 	}
 
 	if fm.dryRun {
 		if fm.verboseLogging {
-			log.Printf("entsquish: DRY RUN would merge %s -> %s",
-				strings.Join(pkg.Files, ", "), outputPath)
+			fm.logf("entsquish: DRY RUN would merge %s -> %s",
+				strings.Join(pkg.Files, ", "), strings.Join(outputPaths, ", "))
+		}
+		if fm.config.DiffWriter != nil {
+			if err := fm.writeDiff(pkg, outputPaths, contents); err != nil {
+				return fmt.Errorf("failed to write diff for package %s: %w", pkg.Path, err)
+			}
 		}
 		return nil
 	}
 
-	// Write merged file using the shared FileSet
-	err = fm.writeMergedFile(outputPath, mergedAST, sharedFileSet)
+	// Record the type errors the package already has
+	var baseline []types.Error
+	if fm.config.Verify {
+		unlock := fm.locks.lockCheck(pkg.Path)
+		baseline, err = fm.packageDiagnostics(pkg.Path, pkg.Files, pkg.Tests)
+		unlock()
+		if err != nil {
+			return fmt.Errorf("failed to type-check package %s: %w", pkg.Path, err)
+		}
+	}
+
+	// Replace the original files, restoring them if anything fails
+	tx, err := newPackageTransaction(pkg, outputPaths...)
+	if err != nil {
+		return fmt.Errorf("failed to prepare package %s: %w", pkg.Path, err)
+	}
+	unlock := fm.locks.lockWrite(pkg.Path)
+	err = tx.Commit(contents...)
+	unlock()
 	if err != nil {
 		return fmt.Errorf("failed to write merged file for package %s: %w", pkg.Path, err)
 	}
 
-	// Remove original files (except if they're the same as output)
-	err = fm.removeOriginalFiles(pkg, outputPath)
-	if err != nil {
-		log.Printf("entsquish: warning: failed to remove original files for package %s: %v", pkg.Path, err)
-		// Don't fail the operation for this
+	if fm.config.Verify {
+		if err := fm.verifyPackage(pkg, tx, baseline); err != nil {
+			return err
+		}
+	}
+
+	if err := recordManifest(pkg.Path, *provenance); err != nil {
+		defer fm.locks.lockWrite(pkg.Path)()
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			err = fmt.Errorf("%w (rollback failed: %v)", err, rollbackErr)
+		}
+		return fmt.Errorf("failed to record manifest for package %s: %w", pkg.Path, err)
+	}
+
+	if storeCache {
+		fm.storeCache(cacheKey, content, cached)
 	}
 
 	if fm.verboseLogging {
-		log.Printf("entsquish: successfully merged package %s", pkg.Path)
+		fm.logf("entsquish: successfully merged package %s", pkg.Path)
 	}
 
 	return nil
 }
 
-// parseFiles parses all Go files in the package.
-func (fm *FileMerger) parseFiles(pkg SquishablePackage, sharedFileSet *token.FileSet) ([]FileInfo, error) {
-	var fileInfos []FileInfo
+// mergeFiles parses and merges the files of pkg, returning the merged
+// content and its provenance and filling in the stats of result.
+func (fm *FileMerger) mergeFiles(pkg SquishablePackage, result *MergeResult) ([]byte, *ManifestOutput, error) {
+	// Create a shared FileSet for all files in this package
+	sharedFileSet := token.NewFileSet()
+
+	// Parse all files in the package using the shared FileSet
+	fileInfos, err := fm.parseFiles(pkg, sharedFileSet)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse files in package %s: %w", pkg.Path, err)
+	}
+
+	// Every kind of package needs something to merge
+	if len(fileInfos) < 2 {
+		return nil, nil, fmt.Errorf("expected at least 2 files in package %s, got %d", pkg.Path, len(fileInfos))
+	}
+
+	// Count the inputs before MergeASTs rewrites them
+	result.Stats.FilesProcessed = len(fileInfos)
+	importsBefore := 0
+	for _, fileInfo := range fileInfos {
+		result.Stats.OriginalSize += fileInfo.Size
+		importsBefore += len(fileInfo.AST.Imports)
+	}
+
+	// Merge the files
+	mergedAST, provenance, err := fm.mergeASTs(fileInfos)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to merge ASTs for package %s: %w", pkg.Path, err)
+	}
+
+	// Format the merged file using the shared FileSet
+	content, err := fm.formatMergedFile(mergedAST, sharedFileSet)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to format merged file for package %s: %w", pkg.Path, err)
+	}
+
+	fm.fillStats(&result.Stats, mergedAST, content, importsBefore)
 
+	return content, provenance, nil
+}
+
+// writeDiff writes the unified diff from the original files of pkg to the
+// merged contents: the output files are added or modified and the other
+// originals are deleted. Paths are relative to the base directory.
+func (fm *FileMerger) writeDiff(pkg SquishablePackage, outputPaths []string, contents [][]byte) error {
+	originals := make(map[string][]byte)
 	for _, fileName := range pkg.Files {
 		filePath := filepath.Join(pkg.Path, fileName)
-
-		// Get file stats
-		stat, err := os.Stat(filePath)
+		original, err := os.ReadFile(filePath)
 		if err != nil {
-			return nil, fmt.Errorf("failed to stat file %s: %w", filePath, err)
+			return fmt.Errorf("failed to read file %s: %w", filePath, err)
 		}
+		originals[filePath] = original
+	}
 
-		// Safety check for file size
-		if stat.Size() > fm.config.MaxFileSize {
-			return nil, fmt.Errorf("file %s exceeds size limit (%d bytes > %d bytes). To increase the limit, add entsquish.WithMaxFileSize(%d) when configuring the extension",
-				filePath, stat.Size(), fm.config.MaxFileSize, stat.Size()+10*1024*1024)
+	// The outputs go first, so the diff reads as "merged into X"
+	var diff strings.Builder
+	outputs := make(map[string]bool)
+	for i, outputPath := range outputPaths {
+		outputs[outputPath] = true
+		outputName := fm.diffName(outputPath)
+		if original, ok := originals[outputPath]; ok {
+			diff.WriteString(unifiedDiff("a/"+outputName, "b/"+outputName, original, contents[i]))
+		} else {
+			diff.WriteString(unifiedDiff("/dev/null", "b/"+outputName, nil, contents[i]))
 		}
+	}
 
-		// Parse the file using the shared FileSet
-		astFile, err := parser.ParseFile(sharedFileSet, filePath, nil, parser.ParseComments)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse file %s: %w", filePath, err)
+	for _, fileName := range pkg.Files {
+		filePath := filepath.Join(pkg.Path, fileName)
+		if !outputs[filePath] {
+			diff.WriteString(unifiedDiff("a/"+fm.diffName(filePath), "/dev/null", originals[filePath], nil))
 		}
+	}
+
+	_, err := io.WriteString(fm.config.DiffWriter, diff.String())
+	return err
+}
+
+// diffName returns the path used for a file in diff headers.
+func (fm *FileMerger) diffName(filePath string) string {
+	rel, err := filepath.Rel(fm.config.BaseDir, filePath)
+	if err != nil {
+		return filepath.ToSlash(filePath)
+	}
+	return filepath.ToSlash(rel)
+}
 
-		fileInfo := FileInfo{
-			Path:        filePath,
-			PackageName: astFile.Name.Name,
-			AST:         astFile,
-			FileSet:     sharedFileSet,
-			Size:        stat.Size(),
+// fillStats records the shape of the merged file in stats.
+func (fm *FileMerger) fillStats(stats *MergeStats, mergedAST *ast.File, content []byte, importsBefore int) {
+	stats.ImportsDeduped = importsBefore - len(mergedAST.Imports)
+	for _, decl := range mergedAST.Decls {
+		if genDecl, ok := decl.(*ast.GenDecl); ok && genDecl.Tok == token.IMPORT {
+			continue
 		}
+		stats.DeclarationsAdded++
+	}
+	stats.LinesTotal = bytes.Count(content, []byte("\n"))
+	stats.MergedSize = int64(len(content))
+	stats.SizeReduction = stats.OriginalSize - stats.MergedSize
+}
+
+// fillShardStats records the size of the shards in stats, in place of the
+// size of the merged file they were split from.
+func (fm *FileMerger) fillShardStats(stats *MergeStats, contents [][]byte) {
+	stats.LinesTotal, stats.MergedSize = 0, 0
+	for _, content := range contents {
+		stats.LinesTotal += bytes.Count(content, []byte("\n"))
+		stats.MergedSize += int64(len(content))
+	}
+	stats.SizeReduction = stats.OriginalSize - stats.MergedSize
+}
+
+// outputPath returns the path of the file pkg is merged into. The shards of
+// a sharded package are numbered after it.
+func (fm *FileMerger) outputPath(pkg SquishablePackage) string {
+	if pkg.OutputFile != "" {
+		// The policy picked the output file name
+		return filepath.Join(pkg.Path, pkg.OutputFile)
+	}
+	if fm.isRootPackage(pkg) {
+		// For root package, use gen.go directly in the directory
+		return filepath.Join(pkg.Path, "gen.go")
+	}
+	// For entity packages, use entity name
+	return filepath.Join(pkg.Path, pkg.EntityName+".go")
+}
+
+// isRootPackage reports whether pkg is the root of the gen tree.
+func (fm *FileMerger) isRootPackage(pkg SquishablePackage) bool {
+	return filepath.Clean(pkg.Path) == fm.config.BaseDir
+}
 
-		fileInfos = append(fileInfos, fileInfo)
+// parseFiles parses all Go files in the package. The caller holds a slot,
+// in which files are parsed one after the other; the slots no other package
+// uses parse more files at a time, so that packages and files share the
+// Concurrency budget. The FileSet is shared, and safe for concurrent use.
+func (fm *FileMerger) parseFiles(pkg SquishablePackage, sharedFileSet *token.FileSet) ([]FileInfo, error) {
+	fileInfos := make([]FileInfo, len(pkg.Files))
+	errs := make([]error, len(pkg.Files))
+
+	var wg sync.WaitGroup
+	for i, fileName := range pkg.Files {
+		select {
+		case fm.slots <- struct{}{}:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				fileInfos[i], errs[i] = fm.parseFile(filepath.Join(pkg.Path, fileName), sharedFileSet)
+				<-fm.slots
+			}()
+		default:
+			fileInfos[i], errs[i] = fm.parseFile(filepath.Join(pkg.Path, fileName), sharedFileSet)
+		}
 	}
+	wg.Wait()
 
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
 	return fileInfos, nil
 }
 
+// parseFile parses a single file into the shared FileSet.
+func (fm *FileMerger) parseFile(filePath string, sharedFileSet *token.FileSet) (FileInfo, error) {
+	// Get file stats
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to stat file %s: %w", filePath, err)
+	}
+
+	// Safety check for file size
+	if err := fm.checkFileSize(filePath, stat.Size()); err != nil {
+		return FileInfo{}, err
+	}
+
+	// Parse the file using the shared FileSet
+	astFile, err := parser.ParseFile(sharedFileSet, filePath, nil, parser.ParseComments)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to parse file %s: %w", filePath, err)
+	}
+
+	return FileInfo{
+		Path:        filePath,
+		PackageName: astFile.Name.Name,
+		AST:         astFile,
+		FileSet:     sharedFileSet,
+		Size:        stat.Size(),
+	}, nil
+}
+
+// checkFileSize rejects files larger than MaxFileSize.
+func (fm *FileMerger) checkFileSize(filePath string, size int64) error {
+	if size > fm.config.MaxFileSize {
+		return fmt.Errorf("file %s exceeds size limit (%d bytes > %d bytes). To increase the limit, add entsquish.WithMaxFileSize(%d) when configuring the extension",
+			filePath, size, fm.config.MaxFileSize, size+10*1024*1024)
+	}
+	return nil
+}
+
 // MergeASTs merges multiple AST files into a single AST.
 func (fm *FileMerger) MergeASTs(fileInfos []FileInfo) (*ast.File, error) {
+	merged, _, err := fm.mergeASTs(fileInfos)
+	return merged, err
+}
+
+// mergeASTs implements MergeASTs. It also returns the provenance of the
+// merged declarations, with every field but Output filled in.
+func (fm *FileMerger) mergeASTs(fileInfos []FileInfo) (*ast.File, *ManifestOutput, error) {
 	if len(fileInfos) == 0 {
-		return nil, fmt.Errorf("no files to merge")
+		return nil, nil, fmt.Errorf("no files to merge")
 	}
 
-	// Use the first file as the base
-	base := fileInfos[0].AST
+	// The lead file provides the header and package doc. Declarations keep
+	// the order of the files, which decides the order init functions run in.
+	lead := fileInfos[fm.leadFile(fileInfos)]
+	base := lead.AST
 	packageName := base.Name.Name
 
 	// Verify all files have the same package name
 	for _, fileInfo := range fileInfos {
 		if fileInfo.AST.Name.Name != packageName {
-			return nil, fmt.Errorf("package name mismatch: %s vs %s",
+			return nil, nil, fmt.Errorf("package name mismatch: %s vs %s",
 				packageName, fileInfo.AST.Name.Name)
 		}
 	}
 
-	// Build a mapping from each file to its import path->alias mapping
-	fileImportMappings := make(map[int]map[string]string) // fileIndex -> importPath -> aliasName
-
-	for i, fileInfo := range fileInfos {
-		fileImportMappings[i] = make(map[string]string)
-		for _, imp := range fileInfo.AST.Imports {
-			path := imp.Path.Value
-
-			if imp.Name != nil {
-				// Has explicit alias
-				fileImportMappings[i][path] = imp.Name.Name
-			} else {
-				// No alias, use package name
-				pathParts := strings.Split(strings.Trim(path, `"`), "/")
-				packageName := pathParts[len(pathParts)-1]
-				fileImportMappings[i][path] = packageName
-			}
+	// Verify all files are built under the same constraint. The lead file's
+	// header carries the constraint line into the merged file.
+	baseConstraint, err := fileConstraint(base, lead.Path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("file %s: %w", lead.Path, err)
+	}
+	for _, fileInfo := range fileInfos {
+		otherConstraint, err := fileConstraint(fileInfo.AST, fileInfo.Path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("file %s: %w", fileInfo.Path, err)
+		}
+		if otherConstraint != baseConstraint {
+			return nil, nil, fmt.Errorf("build constraint mismatch: %q vs %q", baseConstraint, otherConstraint)
 		}
 	}
 
-	// Create merged file
-	merged := &ast.File{
-		Name: &ast.Ident{Name: packageName},
+	// The merged file is not named like its originals, so a constraint
+	// implied by their names must be spelled out
+	var constraintLine string
+	if explicit, _ := buildConstraint(base); explicit != baseConstraint {
+		constraintLine = baseConstraint
 	}
 
 	// Resolve import conflicts and get deduplicated imports
@@ -197,55 +490,432 @@ func (fm *FileMerger) MergeASTs(fileInfos []FileInfo) (*ast.File, error) {
 	for _, path := range importPaths {
 		imports = append(imports, pathToImport[path])
 	}
+	imports = append(imports, importMapping.dotImports...)
 
-	// Merge declarations
-	var allDecls []ast.Decl
-
-	// Add import declarations if we have imports
+	// Build the import declaration if we have imports
+	var importDecl *ast.GenDecl
 	if len(imports) > 0 {
-		genDecl := &ast.GenDecl{
+		importDecl = &ast.GenDecl{
 			Tok:   token.IMPORT,
 			Specs: make([]ast.Spec, len(imports)),
 		}
 		for i, imp := range imports {
-			genDecl.Specs[i] = imp
+			importDecl.Specs[i] = imp
 		}
-		allDecls = append(allDecls, genDecl)
 	}
 
 	// Track seen declarations to avoid duplicates
-	seenDecls := make(map[string]bool)
+	seenDecls := make(map[string]seenDecl)
+	var usedNames map[string]bool // only needed to rename conflicts
+
+	// Collect all other declarations together with their comments, updating
+	// identifiers for each file's context
+	var decls []mergedDecl
+	provenance := &ManifestOutput{}
+	for _, fileInfo := range fileInfos {
+		fileName := filepath.Base(fileInfo.Path)
+		commentMap := ast.NewCommentMap(fileInfo.FileSet, fileInfo.AST, fileInfo.AST.Comments)
+		floating := fm.floatingComments(fileInfo.AST, commentMap)
+
+		// Resolve package references before any identifier is rewritten
+		info := fm.checkFile(fileInfo)
+		references := fm.packageReferences(fileInfo, info)
+		provenance.Files = append(provenance.Files, fm.sourceFile(fileInfo, floating, references))
+		provenance.Aliases = fm.recordAliases(provenance.Aliases, fileName, references, pathToImport)
 
-	// Add all other declarations, updating identifiers for each file's context
-	for i, fileInfo := range fileInfos {
 		for _, decl := range fileInfo.AST.Decls {
+			// Emit comments that belong to no declaration where they appeared
+			for len(floating) > 0 && floating[0].Pos() < decl.Pos() {
+				decls = append(decls, mergedDecl{Comments: floating[:1]})
+				floating = floating[1:]
+			}
+
 			// Skip import declarations as we've already handled them
 			if genDecl, ok := decl.(*ast.GenDecl); ok && genDecl.Tok == token.IMPORT {
 				continue
 			}
 
+			// Update package references in this declaration to the merged
+			// import names, so duplicates compare equal regardless of aliases
+			if len(references) > 0 {
+				fm.updateIdentifiersForDeclaration(decl, references, importMapping.PathToImport)
+			}
+
+			// init functions and blank declarations are never duplicates
+			if !fm.isDeduplicable(decl) {
+				comments := commentMap.Filter(decl).Comments()
+				origin := fm.declarationOrigin(fileInfo, decl, comments)
+				decls = append(decls, mergedDecl{
+					Decl:     decl,
+					Comments: comments,
+					Origin:   origin,
+				})
+				provenance.Declarations = append(provenance.Declarations, origin)
+				continue
+			}
+
 			// Generate a unique signature for this declaration to check for duplicates
 			declSignature := fm.generateDeclarationSignature(decl)
-			if seenDecls[declSignature] {
-				// Skip this duplicate declaration
-				continue
+			position := fileInfo.FileSet.Position(decl.Pos())
+			if first, seen := seenDecls[declSignature]; seen {
+				// Identical duplicates are dropped silently
+				if fm.sameDeclaration(first.decl, decl) {
+					origin := &provenance.Declarations[first.origin]
+					origin.Duplicates = append(origin.Duplicates, fileName)
+					continue
+				}
+
+				conflict := &ConflictError{
+					Signature: declSignature,
+					First:     first.position,
+					Second:    position,
+				}
+
+				switch fm.config.ConflictPolicy {
+				case ConflictKeepFirst:
+					if fm.verboseLogging {
+						fm.logf("entsquish: warning: %v, keeping the first", conflict)
+					}
+					continue
+				case ConflictRename:
+					if usedNames == nil {
+						usedNames = fm.CollectAllIdentifiers(fileInfos)
+					}
+					newName, err := fm.renameDeclaration(decl, fileInfo, info, usedNames)
+					if err != nil {
+						return nil, nil, fmt.Errorf("%w: %v", conflict, err)
+					}
+					if fm.verboseLogging {
+						fm.logf("entsquish: warning: %v, renamed the second to %s", conflict, newName)
+					}
+					declSignature = fm.generateDeclarationSignature(decl)
+				default:
+					return nil, nil, conflict
+				}
 			}
-			seenDecls[declSignature] = true
+			seenDecls[declSignature] = seenDecl{decl: decl, position: position, origin: len(provenance.Declarations)}
+
+			comments := commentMap.Filter(decl).Comments()
+			origin := fm.declarationOrigin(fileInfo, decl, comments)
+			decls = append(decls, mergedDecl{
+				Decl:     decl,
+				Comments: comments,
+				Origin:   origin,
+			})
+			provenance.Declarations = append(provenance.Declarations, origin)
+		}
+
+		for _, group := range floating {
+			decls = append(decls, mergedDecl{Comments: []*ast.CommentGroup{group}})
+		}
+	}
+
+	merged, err := fm.renderMergedFile(lead, constraintLine, importDecl, decls)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Name the declarations after any renames, as they appear in the output
+	names := fm.declarationNames(merged)
+	if len(names) != len(provenance.Declarations) {
+		return nil, nil, fmt.Errorf("merged file has %d declarations, expected %d", len(names), len(provenance.Declarations))
+	}
+	for i, name := range names {
+		provenance.Declarations[i].Name = name
+	}
+
+	return merged, provenance, nil
+}
+
+// sourceFile describes an original file for the manifest. references are
+// the file's package references, resolved before any rewrite.
+func (fm *FileMerger) sourceFile(fileInfo FileInfo, floating []*ast.CommentGroup, references map[*ast.Ident]packageReference) SourceFile {
+	var preamble bytes.Buffer
+	fm.writeHeader(&preamble, fileInfo.FileSet, fileInfo.AST, false)
+
+	source := SourceFile{
+		Name:     filepath.Base(fileInfo.Path),
+		Preamble: preamble.String(),
+	}
 
-			// Update identifiers for this declaration based on this file's import context
-			if len(fileImportMappings[i]) > 0 {
-				fm.updateIdentifiersForDeclaration(decl, fileImportMappings[i], importMapping.PathToImport)
+	// The identifier used for an import without a name comes from the code
+	idents := make(map[string]string)
+	for ident, reference := range references {
+		idents[reference.ImportPath] = ident.Name
+	}
+
+	group, lastLine := 0, 0
+	for _, imp := range fileInfo.AST.Imports {
+		path, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			path = imp.Path.Value
+		}
+
+		line := fileInfo.FileSet.Position(imp.Pos()).Line
+		if lastLine > 0 && line > lastLine+1 {
+			group++
+		}
+		lastLine = fileInfo.FileSet.Position(imp.End()).Line
+
+		sourceImport := SourceImport{Path: path, Group: group}
+		if imp.Name != nil {
+			sourceImport.Name = imp.Name.Name
+			if imp.Name.Name != "_" && imp.Name.Name != "." {
+				sourceImport.Ident = imp.Name.Name
 			}
+		} else if ident, ok := idents[imp.Path.Value]; ok {
+			sourceImport.Ident = ident
+		} else {
+			sourceImport.Ident = importPathName(path)
+		}
+		source.Imports = append(source.Imports, sourceImport)
+	}
+
+	for _, group := range floating {
+		source.Comments = append(source.Comments, commentText(group))
+	}
+
+	return source
+}
 
-			allDecls = append(allDecls, decl)
+// declarationOrigin records the file and lines decl occupies in fileInfo,
+// along with the comments that belong to it.
+func (fm *FileMerger) declarationOrigin(fileInfo FileInfo, decl ast.Decl, comments []*ast.CommentGroup) DeclarationOrigin {
+	start, end := decl.Pos(), decl.End()
+	if len(comments) > 0 {
+		start = min(start, comments[0].Pos())
+		end = max(end, comments[len(comments)-1].End())
+	}
+
+	return DeclarationOrigin{
+		File:      filepath.Base(fileInfo.Path),
+		StartLine: fileInfo.FileSet.Position(start).Line,
+		EndLine:   fileInfo.FileSet.Position(end).Line,
+	}
+}
+
+// recordAliases adds the imports whose references in fileName are renamed
+// for the merged import block to aliases, keeping them sorted by path.
+func (fm *FileMerger) recordAliases(aliases []ImportAlias, fileName string, references map[*ast.Ident]packageReference, finalImports map[string]*ast.ImportSpec) []ImportAlias {
+	renamed := make(map[string]string)
+	for ident, reference := range references {
+		finalImport, exists := finalImports[reference.ImportPath]
+		if !exists {
+			continue
+		}
+		name := reference.PackageName
+		if finalImport.Name != nil {
+			name = finalImport.Name.Name
+		}
+		if ident.Name != name {
+			renamed[reference.ImportPath] = name
 		}
 	}
 
-	merged.Decls = allDecls
+	for quotedPath, name := range renamed {
+		path, err := strconv.Unquote(quotedPath)
+		if err != nil {
+			path = quotedPath
+		}
+
+		i := sort.Search(len(aliases), func(i int) bool { return aliases[i].Path >= path })
+		if i == len(aliases) || aliases[i].Path != path {
+			aliases = append(aliases, ImportAlias{})
+			copy(aliases[i+1:], aliases[i:])
+			aliases[i] = ImportAlias{Path: path, Name: name}
+		}
+		aliases[i].Files = append(aliases[i].Files, fileName)
+	}
+	return aliases
+}
+
+// declarationNames names the declarations of file in order, leaving out
+// imports. Declarations without a name to deduplicate by, such as blank
+// variables, are named after their kind.
+func (fm *FileMerger) declarationNames(file *ast.File) []string {
+	var names []string
+	for _, decl := range file.Decls {
+		genDecl, isGenDecl := decl.(*ast.GenDecl)
+		if isGenDecl && genDecl.Tok == token.IMPORT {
+			continue
+		}
+
+		name := fm.generateDeclarationSignature(decl)
+		if isGenDecl && strings.HasPrefix(name, "unknown:") {
+			name = genDecl.Tok.String() + ":_"
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// floatingComments returns the comment groups below the package clause
+// that the comment map does not attach to any declaration, such as
+// //go:generate directives in a file without declarations.
+func (fm *FileMerger) floatingComments(file *ast.File, commentMap ast.CommentMap) []*ast.CommentGroup {
+	attached := make(map[*ast.CommentGroup]bool)
+	for _, decl := range file.Decls {
+		for _, group := range commentMap.Filter(decl).Comments() {
+			attached[group] = true
+		}
+	}
+
+	var floating []*ast.CommentGroup
+	for _, group := range file.Comments {
+		if group.Pos() > file.Package && !attached[group] {
+			floating = append(floating, group)
+		}
+	}
+	return floating
+}
+
+// mergedDecl is a declaration headed for the merged file along with the
+// comments that belong to it. A nil Decl stands for a free-standing comment.
+type mergedDecl struct {
+	Decl     ast.Decl
+	Comments []*ast.CommentGroup
+
+	// Origin is where the declaration and its comments came from
+	Origin DeclarationOrigin
+}
+
+// renderMergedFile prints the lead file's header, the package clause, the
+// merged imports and every declaration with its comments, then parses the
+// result into lead.FileSet. Positions taken from different source files
+// cannot be mixed in a single ast.File without misplacing comments, so the
+// merged file gets positions of its own. A non-empty constraint expr
+// replaces the build constraint lines of the header.
+func (fm *FileMerger) renderMergedFile(lead FileInfo, expr string, importDecl *ast.GenDecl, decls []mergedDecl) (*ast.File, error) {
+	fileSet := lead.FileSet
+	var buf bytes.Buffer
+
+	if expr != "" {
+		fmt.Fprintf(&buf, "//go:build %s\n\n", expr)
+	}
+	fm.writeHeader(&buf, fileSet, lead.AST, expr != "")
+	fmt.Fprintf(&buf, "package %s\n", lead.AST.Name.Name)
+
+	if importDecl != nil {
+		buf.WriteString("\n")
+		if err := format.Node(&buf, fileSet, importDecl); err != nil {
+			return nil, fmt.Errorf("failed to print imports: %w", err)
+		}
+		buf.WriteString("\n")
+	}
+
+	for _, decl := range decls {
+		buf.WriteString("\n")
+		if decl.Decl == nil {
+			for _, group := range decl.Comments {
+				for _, comment := range group.List {
+					buf.WriteString(comment.Text)
+					buf.WriteString("\n")
+				}
+			}
+			continue
+		}
+		if fm.config.LineDirectives {
+			buf.WriteString(lineDirective(decl.Origin))
+		}
+		node := &printer.CommentedNode{Node: decl.Decl, Comments: decl.Comments}
+		if err := format.Node(&buf, fileSet, node); err != nil {
+			return nil, fmt.Errorf("failed to print declaration: %w", err)
+		}
+		buf.WriteString("\n")
+	}
+
+	merged, err := parser.ParseFile(fileSet, fm.mergedFileName(lead), buf.Bytes(), parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse merged file: %w", err)
+	}
 
 	return merged, nil
 }
 
+// lineDirective returns the //line directive placed above a declaration.
+// It stands apart from the declaration's comments, since gofmt moves
+// directives to the end of a doc comment, and names the blank line below it.
+func lineDirective(origin DeclarationOrigin) string {
+	return fmt.Sprintf("//line %s:%d\n\n", origin.File, origin.StartLine-1)
+}
+
+// writeHeader writes the comment groups above the package clause of file,
+// keeping blank lines between groups. With skipConstraints, build constraint
+// lines are left out.
+func (fm *FileMerger) writeHeader(buf *bytes.Buffer, fileSet *token.FileSet, file *ast.File, skipConstraints bool) {
+	var header []*ast.CommentGroup
+	for _, group := range fm.headerComments(file) {
+		if skipConstraints {
+			var kept []*ast.Comment
+			for _, comment := range group.List {
+				if !constraint.IsGoBuild(comment.Text) && !constraint.IsPlusBuild(comment.Text) {
+					kept = append(kept, comment)
+				}
+			}
+			if len(kept) == 0 {
+				continue
+			}
+			if len(kept) < len(group.List) {
+				group = &ast.CommentGroup{List: kept}
+			}
+		}
+		header = append(header, group)
+	}
+	for i, group := range header {
+		if i > 0 && fileSet.Position(group.Pos()).Line > fileSet.Position(header[i-1].End()).Line+1 {
+			buf.WriteString("\n")
+		}
+		for _, comment := range group.List {
+			buf.WriteString(comment.Text)
+			buf.WriteString("\n")
+		}
+	}
+
+	// The package doc sits right above the package clause
+	if len(header) > 0 && header[len(header)-1] != file.Doc {
+		buf.WriteString("\n")
+	}
+}
+
+// mergedFileName returns the name the merged file is registered under in
+// the FileSet.
+func (fm *FileMerger) mergedFileName(lead FileInfo) string {
+	if lead.Path == "" {
+		return "merged.go"
+	}
+	return filepath.Join(filepath.Dir(lead.Path), "merged.go")
+}
+
+// leadFile returns the index of the lead file: the first one carrying a
+// package doc comment, or failing that the first one with a header (e.g. the
+// "Code generated" marker), or failing that the first one.
+func (fm *FileMerger) leadFile(fileInfos []FileInfo) int {
+	for i, fileInfo := range fileInfos {
+		if fileInfo.AST.Doc != nil {
+			return i
+		}
+	}
+	for i, fileInfo := range fileInfos {
+		if len(fm.headerComments(fileInfo.AST)) > 0 {
+			return i
+		}
+	}
+	return 0
+}
+
+// headerComments returns the comment groups above the package clause,
+// including the package doc comment.
+func (fm *FileMerger) headerComments(file *ast.File) []*ast.CommentGroup {
+	var header []*ast.CommentGroup
+	for _, group := range file.Comments {
+		if group.End() >= file.Package {
+			break
+		}
+		header = append(header, group)
+	}
+	return header
+}
+
 // getImportKey generates a unique key for an import spec.
 func (fm *FileMerger) getImportKey(imp *ast.ImportSpec) string {
 	path := imp.Path.Value
@@ -259,6 +929,10 @@ func (fm *FileMerger) getImportKey(imp *ast.ImportSpec) string {
 type ImportAliasMapping struct {
 	PathToImport       map[string]*ast.ImportSpec // import path to import spec
 	packageNameToAlias map[string]string          // package name to its final alias in merged file
+
+	// dotImports are dot imports of paths that PathToImport also imports
+	// by name, which the merged file keeps next to the named import
+	dotImports []*ast.ImportSpec
 }
 
 // resolveImportConflicts creates a consistent import mapping to avoid naming conflicts.
@@ -280,11 +954,23 @@ func (fm *FileMerger) ResolveImportConflicts(fileInfos []FileInfo) ImportAliasMa
 	// Collect ALL identifiers across all files to detect conflicts
 	usedIdentifiers := fm.CollectAllIdentifiers(fileInfos)
 
+	// Blank and dot imports by path, "." winning over "_"
+	unnamed := make(map[string]string)
+
 	// Now process imports and resolve conflicts
 	for _, fileInfo := range fileInfos {
 		for _, imp := range fileInfo.AST.Imports {
 			path := imp.Path.Value
 
+			// References are never rewritten to a blank or dot import, so
+			// those are only kept once the named imports are known
+			if imp.Name != nil && (imp.Name.Name == "_" || imp.Name.Name == ".") {
+				if unnamed[path] != "." {
+					unnamed[path] = imp.Name.Name
+				}
+				continue
+			}
+
 			// Skip if we've already processed this path
 			if _, exists := pathToImport[path]; exists {
 				continue
@@ -323,8 +1009,10 @@ func (fm *FileMerger) ResolveImportConflicts(fileInfos []FileInfo) ImportAliasMa
 			}
 
 			// Create the import spec with the resolved alias
+			// The path literal is copied without its position so the merged
+			// import block is laid out without stray blank lines.
 			resolvedImport := &ast.ImportSpec{
-				Path: imp.Path,
+				Path: &ast.BasicLit{Kind: token.STRING, Value: imp.Path.Value},
 			}
 
 			// Add alias if it's different from the package name or if it's a standard alias or explicit alias
@@ -341,9 +1029,26 @@ func (fm *FileMerger) ResolveImportConflicts(fileInfos []FileInfo) ImportAliasMa
 		}
 	}
 
+	// A blank import is only kept if nothing else imports its path, while a
+	// dot import is kept next to a named one
+	var dotImports []*ast.ImportSpec
+	for path, name := range unnamed {
+		spec := &ast.ImportSpec{
+			Name: &ast.Ident{Name: name},
+			Path: &ast.BasicLit{Kind: token.STRING, Value: path},
+		}
+		if _, exists := pathToImport[path]; !exists {
+			pathToImport[path] = spec
+		} else if name == "." {
+			dotImports = append(dotImports, spec)
+		}
+	}
+	sort.Slice(dotImports, func(i, j int) bool { return dotImports[i].Path.Value < dotImports[j].Path.Value })
+
 	return ImportAliasMapping{
 		PathToImport:       pathToImport,
 		packageNameToAlias: packageNameToAlias,
+		dotImports:         dotImports,
 	}
 }
 
@@ -380,6 +1085,15 @@ func (fm *FileMerger) CollectAllIdentifiers(fileInfos []FileInfo) map[string]boo
 					for _, spec := range x.Specs {
 						if typeSpec, ok := spec.(*ast.TypeSpec); ok {
 							usedIdentifiers[typeSpec.Name.Name] = true
+
+							// Type parameters of generic types
+							if typeSpec.TypeParams != nil {
+								for _, field := range typeSpec.TypeParams.List {
+									for _, name := range field.Names {
+										usedIdentifiers[name.Name] = true
+									}
+								}
+							}
 						}
 					}
 				}
@@ -400,6 +1114,17 @@ func (fm *FileMerger) CollectAllIdentifiers(fileInfos []FileInfo) map[string]boo
 					}
 				}
 
+				// Type parameters of generic functions
+				if x.Type.TypeParams != nil {
+					for _, field := range x.Type.TypeParams.List {
+						for _, name := range field.Names {
+							if name != nil {
+								usedIdentifiers[name.Name] = true
+							}
+						}
+					}
+				}
+
 				// Function parameters
 				if x.Type.Params != nil {
 					for _, field := range x.Type.Params.List {
@@ -564,84 +1289,49 @@ func (fm *FileMerger) SanitizeIdentifier(name string) string {
 	return "pkg"
 }
 
-// updateIdentifiersForDeclaration updates identifiers in a declaration based on the
-// original file's import context and the final merged import specs.
-func (fm *FileMerger) updateIdentifiersForDeclaration(decl ast.Decl, originalImports map[string]string, finalImports map[string]*ast.ImportSpec) {
-	// Build a mapping from original alias to final alias
-	aliasMap := make(map[string]string)
-
-	for importPath, originalAlias := range originalImports {
-		if finalImport, exists := finalImports[importPath]; exists {
-			var finalAlias string
-			if finalImport.Name != nil {
-				finalAlias = finalImport.Name.Name
-			} else {
-				// No alias in final import, use package name
-				pathParts := strings.Split(strings.Trim(importPath, `"`), "/")
-				finalAlias = pathParts[len(pathParts)-1]
-			}
+// updateIdentifiersForDeclaration renames the identifiers in a declaration
+// that the type checker resolved to an imported package, so they use the
+// package's name in the merged import block. Any other identifier is left
+// alone, even if it shares the name of an import.
+func (fm *FileMerger) updateIdentifiersForDeclaration(decl ast.Decl, references map[*ast.Ident]packageReference, finalImports map[string]*ast.ImportSpec) {
+	ast.Inspect(decl, func(n ast.Node) bool {
+		ident, ok := n.(*ast.Ident)
+		if !ok {
+			return true
+		}
 
-			// Only add to map if the alias changed
-			if originalAlias != finalAlias {
-				aliasMap[originalAlias] = finalAlias
-			}
+		reference, ok := references[ident]
+		if !ok {
+			return true
 		}
-	}
 
-	// Update identifiers in this declaration
-	if len(aliasMap) > 0 {
-		ast.Inspect(decl, func(n ast.Node) bool {
-			switch x := n.(type) {
-			case *ast.SelectorExpr:
-				// Check if this is a package selector (e.g., sql.Selector)
-				if ident, ok := x.X.(*ast.Ident); ok {
-					// If the identifier matches an original alias that changed
-					if newAlias, exists := aliasMap[ident.Name]; exists {
-						// Update the identifier to use the new alias
-						ident.Name = newAlias
-					}
-				}
-			}
+		finalImport, exists := finalImports[reference.ImportPath]
+		if !exists {
 			return true
-		})
-	}
-}
+		}
 
-// updateIdentifiersForAliases walks the AST and updates selector expressions
-// to use the correct aliases for imports that have been aliased.
-func (fm *FileMerger) updateIdentifiersForAliases(node ast.Node, aliasMap map[string]string) {
-	ast.Inspect(node, func(n ast.Node) bool {
-		switch x := n.(type) {
-		case *ast.SelectorExpr:
-			// Check if this is a package selector (e.g., sql.Selector)
-			if ident, ok := x.X.(*ast.Ident); ok {
-				// If the identifier matches a package name that was aliased
-				if alias, exists := aliasMap[ident.Name]; exists {
-					// Update the identifier to use the alias
-					ident.Name = alias
-				}
+		if finalImport.Name != nil {
+			if finalImport.Name.Name == "_" || finalImport.Name.Name == "." {
+				return true
 			}
+			ident.Name = finalImport.Name.Name
+		} else {
+			// No alias in final import, use package name
+			ident.Name = reference.PackageName
 		}
 		return true
 	})
 }
 
-// writeMergedFile writes the merged AST to a file.
-func (fm *FileMerger) writeMergedFile(outputPath string, mergedAST *ast.File, fileSet *token.FileSet) error {
-	// Format the AST
-	var buf strings.Builder
+// formatMergedFile prints the merged AST.
+func (fm *FileMerger) formatMergedFile(mergedAST *ast.File, fileSet *token.FileSet) ([]byte, error) {
+	var buf bytes.Buffer
 	err := format.Node(&buf, fileSet, mergedAST)
 	if err != nil {
-		return fmt.Errorf("failed to format merged AST: %w", err)
-	}
-
-	// Write to file
-	err = os.WriteFile(outputPath, []byte(buf.String()), 0644)
-	if err != nil {
-		return fmt.Errorf("failed to write file %s: %w", outputPath, err)
+		return nil, fmt.Errorf("failed to format merged AST: %w", err)
 	}
 
-	return nil
+	return buf.Bytes(), nil
 }
 
 // generateDeclarationSignature creates a unique signature for a declaration to detect duplicates.
@@ -654,10 +1344,17 @@ func (fm *FileMerger) generateDeclarationSignature(decl ast.Decl) string {
 			switch s := spec.(type) {
 			case *ast.TypeSpec:
 				// For type declarations, use "type:name"
+				if s.Name.Name == "_" {
+					continue
+				}
 				signatures = append(signatures, fmt.Sprintf("type:%s", s.Name.Name))
 			case *ast.ValueSpec:
-				// For var/const declarations, use "var:name" or "const:name"
+				// For var/const declarations, use "var:name" or "const:name".
+				// Blank identifiers never clash and are left out.
 				for _, name := range s.Names {
+					if name.Name == "_" {
+						continue
+					}
 					if d.Tok == token.VAR {
 						signatures = append(signatures, fmt.Sprintf("var:%s", name.Name))
 					} else if d.Tok == token.CONST {
@@ -685,6 +1382,38 @@ func (fm *FileMerger) generateDeclarationSignature(decl ast.Decl) string {
 	return fmt.Sprintf("unknown:%p", decl)
 }
 
+// isDeduplicable reports whether a declaration takes part in duplicate
+// detection. init functions and declarations of blank identifiers only
+// (e.g. interface assertions like var _ ent.Mutation = (*UserMutation)(nil))
+// may legitimately appear any number of times and are always kept, in
+// their original order.
+func (fm *FileMerger) isDeduplicable(decl ast.Decl) bool {
+	switch d := decl.(type) {
+	case *ast.FuncDecl:
+		if d.Name.Name == "_" {
+			return false
+		}
+		return d.Recv != nil || d.Name.Name != "init"
+	case *ast.GenDecl:
+		for _, spec := range d.Specs {
+			switch s := spec.(type) {
+			case *ast.TypeSpec:
+				if s.Name.Name != "_" {
+					return true
+				}
+			case *ast.ValueSpec:
+				for _, name := range s.Names {
+					if name.Name != "_" {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+	return true
+}
+
 // getTypeName extracts the type name from an expression (for receiver types).
 func (fm *FileMerger) getTypeName(expr ast.Expr) string {
 	switch e := expr.(type) {
@@ -698,25 +1427,15 @@ func (fm *FileMerger) getTypeName(expr ast.Expr) string {
 		if ident, ok := e.X.(*ast.Ident); ok {
 			return fmt.Sprintf("%s.%s", ident.Name, e.Sel.Name)
 		}
+	case *ast.IndexExpr:
+		// Generic type with one type parameter: Type[T] -> Type
+		return fm.getTypeName(e.X)
+	case *ast.IndexListExpr:
+		// Generic type with several type parameters: Type[K, V] -> Type
+		return fm.getTypeName(e.X)
+	case *ast.ParenExpr:
+		// Parenthesized receiver: (*Type) -> Type
+		return fm.getTypeName(e.X)
 	}
 	return "unknown"
 }
-
-// removeOriginalFiles removes the original files after successful merge.
-func (fm *FileMerger) removeOriginalFiles(pkg SquishablePackage, outputPath string) error {
-	for _, fileName := range pkg.Files {
-		filePath := filepath.Join(pkg.Path, fileName)
-
-		// Don't remove if it's the same as output path
-		if filePath == outputPath {
-			continue
-		}
-
-		err := os.Remove(filePath)
-		if err != nil {
-			return fmt.Errorf("failed to remove file %s: %w", filePath, err)
-		}
-	}
-
-	return nil
-}
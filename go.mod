@@ -2,7 +2,11 @@ module github.com/codelite7/entsquish
 
 go 1.25.0
 
-require entgo.io/ent v0.14.5
+require (
+	entgo.io/ent v0.14.5
+	golang.org/x/mod v0.23.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	ariga.io/atlas v0.32.1-0.20250325101103-175b25e1c1b9 // indirect
@@ -17,7 +21,6 @@ require (
 	github.com/rogpeppe/go-internal v1.14.1 // indirect
 	github.com/zclconf/go-cty v1.14.4 // indirect
 	github.com/zclconf/go-cty-yaml v1.1.0 // indirect
-	golang.org/x/mod v0.23.0 // indirect
 	golang.org/x/sync v0.11.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
 	golang.org/x/tools v0.30.0 // indirect
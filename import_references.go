@@ -0,0 +1,168 @@
+package entsquish
+
+import (
+	"go/ast"
+	"go/types"
+	"strings"
+)
+
+// checkFile type-checks a single file in isolation and returns what the
+// checker recorded about it.
+//
+// Imports are satisfied by empty stub packages: which identifiers denote a
+// package or a declaration of the file only depends on the file's own
+// scopes, not on the contents of the imported packages. The resulting
+// "undefined" errors are expected and ignored.
+func (fm *FileMerger) checkFile(fileInfo FileInfo) *types.Info {
+	info := &types.Info{
+		Defs:      make(map[*ast.Ident]types.Object),
+		Uses:      make(map[*ast.Ident]types.Object),
+		Implicits: make(map[ast.Node]types.Object),
+		Scopes:    make(map[ast.Node]*types.Scope),
+	}
+
+	config := &types.Config{
+		Importer:    stubImporter{},
+		Error:       func(error) {}, // keep going, stub packages are empty
+		FakeImportC: true,
+	}
+
+	// Check returns the first error, which is expected here
+	_, _ = config.Check(fileInfo.PackageName, fileInfo.FileSet, []*ast.File{fileInfo.AST}, info)
+
+	return info
+}
+
+// packageReferences returns the identifiers of a type-checked file that
+// refer to an imported package, keyed to the import path literal of the
+// import that declares them. Resolution follows the Go scoping rules, so
+// locals, parameters and fields that share an import's name are never
+// reported, no matter how deeply they are nested.
+func (fm *FileMerger) packageReferences(fileInfo FileInfo, info *types.Info) map[*ast.Ident]packageReference {
+	fileScope := info.Scopes[fileInfo.AST]
+
+	// Map each imported package name back to the import spec declaring it
+	importPaths := make(map[*types.PkgName]string)
+	for _, imp := range fileInfo.AST.Imports {
+		var obj types.Object
+		if imp.Name != nil {
+			obj = info.Defs[imp.Name]
+		} else {
+			obj = info.Implicits[imp]
+		}
+		if pkgName, ok := obj.(*types.PkgName); ok {
+			importPaths[pkgName] = imp.Path.Value
+		}
+	}
+
+	references := make(map[*ast.Ident]packageReference)
+	ast.Inspect(fileInfo.AST, func(n ast.Node) bool {
+		selector, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		ident, ok := selector.X.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		pkgName := fm.resolvePackageName(ident, info, fileScope)
+		if pkgName == nil {
+			return true
+		}
+		if path, ok := importPaths[pkgName]; ok {
+			references[ident] = packageReference{
+				ImportPath:  path,
+				PackageName: pkgName.Imported().Name(),
+			}
+		}
+		return true
+	})
+
+	return references
+}
+
+// resolvePackageName returns the package ident refers to, or nil if it
+// refers to anything else.
+//
+// The checker does not descend into every expression whose operand is
+// invalid, e.g. the type in x.(T) when x's type lives in a stub package.
+// Identifiers it never visited are resolved by looking their name up from
+// the innermost recorded scope, unless the parser already bound them to a
+// local declaration the checker did not see.
+func (fm *FileMerger) resolvePackageName(ident *ast.Ident, info *types.Info, fileScope *types.Scope) *types.PkgName {
+	if obj, ok := info.Uses[ident]; ok {
+		pkgName, _ := obj.(*types.PkgName)
+		return pkgName
+	}
+
+	if ident.Obj != nil || fileScope == nil {
+		return nil
+	}
+
+	scope := fileScope.Innermost(ident.Pos())
+	if scope == nil {
+		scope = fileScope
+	}
+
+	_, obj := scope.LookupParent(ident.Name, ident.Pos())
+	pkgName, _ := obj.(*types.PkgName)
+	return pkgName
+}
+
+// packageReference describes an identifier that names an imported package.
+type packageReference struct {
+	// ImportPath is the quoted import path, as in ast.ImportSpec.Path.Value
+	ImportPath string
+
+	// PackageName is the name declared by the imported package
+	PackageName string
+}
+
+// stubImporter imports every package as an empty, complete package whose
+// name is derived from its import path.
+type stubImporter struct{}
+
+// Import implements types.Importer.
+func (stubImporter) Import(path string) (*types.Package, error) {
+	if path == "unsafe" {
+		return types.Unsafe, nil
+	}
+	pkg := types.NewPackage(path, importPathName(path))
+	pkg.MarkComplete()
+	return pkg, nil
+}
+
+// importPathName guesses the name of the package at path following the
+// usual conventions: the last path element, without a major version
+// suffix ("/v2", ".v3") or a "go-" prefix.
+func importPathName(path string) string {
+	elements := strings.Split(path, "/")
+	name := elements[len(elements)-1]
+
+	// Major version directories such as example.com/mod/v2
+	if len(elements) > 1 && isMajorVersion(name) {
+		name = elements[len(elements)-2]
+	}
+
+	// gopkg.in style versions such as gopkg.in/yaml.v3
+	if i := strings.LastIndex(name, "."); i > 0 && isMajorVersion(name[i+1:]) {
+		name = name[:i]
+	}
+
+	name = strings.TrimPrefix(name, "go-")
+	name = strings.NewReplacer("-", "", ".", "").Replace(name)
+	return name
+}
+
+// isMajorVersion reports whether element looks like "v2", "v10", etc.
+func isMajorVersion(element string) bool {
+	if len(element) < 2 || element[0] != 'v' {
+		return false
+	}
+	for _, r := range element[1:] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,329 @@
+package entsquish
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// JournalDir is the directory inside the target directory that records a
+// squish run in progress. It holds journal.json and a backup of every file
+// the run replaces, and is removed once the run completes.
+const JournalDir = ".entsquish-journal"
+
+// journalVersion is the version of the journal.json format.
+const journalVersion = 1
+
+// ErrInterruptedRun is returned when a journal left behind by an earlier
+// run is found. Recover rolls back or finishes that run.
+var ErrInterruptedRun = errors.New("found the journal of an interrupted squish run")
+
+// RecoveryMode selects how Recover deals with an interrupted run.
+type RecoveryMode int
+
+const (
+	// RecoverRollback restores every package the interrupted run touched,
+	// leaving the tree as the generator wrote it.
+	RecoverRollback RecoveryMode = iota
+
+	// RecoverFinish restores the package that was being merged when the run
+	// was interrupted, keeps the packages that were already squished and
+	// squishes the remaining ones.
+	RecoverFinish
+)
+
+// String returns the string representation of RecoveryMode.
+func (m RecoveryMode) String() string {
+	switch m {
+	case RecoverRollback:
+		return "rollback"
+	case RecoverFinish:
+		return "finish"
+	default:
+		return "unknown"
+	}
+}
+
+// journal records the packages of a squish run along with backups of their
+// original files.
+type journal struct {
+	// baseDir is the directory being squished
+	baseDir string
+
+	// mu serializes the updates of packages merged concurrently
+	mu sync.Mutex
+
+	// Version is the journal format version
+	Version int `json:"version"`
+
+	// Entries lists the packages in the order they were started
+	Entries []journalEntry `json:"packages"`
+}
+
+// journalEntry records a single package. Paths are relative to baseDir and
+// backups are stored under JournalDir/<index>/<file>.
+type journalEntry struct {
+	// Path is the package directory
+	Path string `json:"path"`
+
+	// Output is the merged file
+	Output string `json:"output"`
+
+	// Sharded is set if the package is split into shards of Output
+	Sharded bool `json:"sharded,omitempty"`
+
+	// Files are the original files
+	Files []string `json:"files"`
+
+	// Done is set once the package was squished
+	Done bool `json:"done"`
+}
+
+// journalPath returns the path of journal.json for baseDir.
+func journalPath(baseDir string) string {
+	return filepath.Join(baseDir, JournalDir, "journal.json")
+}
+
+// createJournal starts the journal of a new run. It fails with
+// ErrInterruptedRun if an earlier run left its journal behind.
+func createJournal(baseDir string) (*journal, error) {
+	if _, err := os.Stat(filepath.Join(baseDir, JournalDir)); err == nil {
+		return nil, fmt.Errorf("%w in %s, run recovery first", ErrInterruptedRun, baseDir)
+	}
+
+	if err := os.Mkdir(filepath.Join(baseDir, JournalDir), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %w", err)
+	}
+
+	j := &journal{baseDir: baseDir, Version: journalVersion}
+	if err := j.save(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// loadJournal reads the journal left in baseDir. It returns nil if there is
+// none.
+func loadJournal(baseDir string) (*journal, error) {
+	data, err := os.ReadFile(journalPath(baseDir))
+	if os.IsNotExist(err) {
+		// A run interrupted before its first write leaves an empty directory
+		if _, statErr := os.Stat(filepath.Join(baseDir, JournalDir)); statErr == nil {
+			return &journal{baseDir: baseDir, Version: journalVersion}, nil
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+
+	j := &journal{baseDir: baseDir}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("failed to parse journal: %w", err)
+	}
+	if j.Version != journalVersion {
+		return nil, fmt.Errorf("unsupported journal version %d", j.Version)
+	}
+	return j, nil
+}
+
+// save writes journal.json atomically.
+func (j *journal) save() error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode journal: %w", err)
+	}
+	if err := writeFileAtomic(journalPath(j.baseDir), data, 0644); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	return syncDir(filepath.Join(j.baseDir, JournalDir))
+}
+
+// begin backs up the original files of pkg and records it before the merge
+// touches anything. It returns the index of the new entry.
+func (j *journal) begin(pkg SquishablePackage, outputPath string, sharded bool) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	tx, err := newPackageTransaction(pkg, outputPath)
+	if err != nil {
+		return 0, err
+	}
+
+	index := len(j.Entries)
+	backupDir := j.backupDir(index)
+
+	// Backups are written before the entry, so an entry always has them
+	if err := os.MkdirAll(backupDir, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	entry := journalEntry{Sharded: sharded}
+	for _, filePath := range tx.order {
+		original := tx.originals[filePath]
+		if err := writeFileAtomic(filepath.Join(backupDir, filepath.Base(filePath)), original.data, original.mode); err != nil {
+			_ = os.RemoveAll(backupDir)
+			return 0, fmt.Errorf("failed to back up %s: %w", filePath, err)
+		}
+
+		rel, err := filepath.Rel(j.baseDir, filePath)
+		if err != nil {
+			_ = os.RemoveAll(backupDir)
+			return 0, err
+		}
+		entry.Files = append(entry.Files, rel)
+	}
+	if err := syncDir(backupDir); err != nil {
+		_ = os.RemoveAll(backupDir)
+		return 0, err
+	}
+
+	if entry.Path, err = filepath.Rel(j.baseDir, pkg.Path); err != nil {
+		return 0, err
+	}
+	if entry.Output, err = filepath.Rel(j.baseDir, outputPath); err != nil {
+		return 0, err
+	}
+
+	j.Entries = append(j.Entries, entry)
+	if err := j.save(); err != nil {
+		j.Entries = j.Entries[:index]
+		_ = os.RemoveAll(backupDir)
+		return 0, err
+	}
+	return index, nil
+}
+
+// finish records the outcome of the merge of an entry. A failed merge left
+// the package untouched, so its entry is dropped.
+func (j *journal) finish(index int, merged bool) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if merged {
+		j.Entries[index].Done = true
+		return j.save()
+	}
+
+	// Keep the indexes of later entries stable by leaving a placeholder
+	j.Entries[index] = journalEntry{Path: j.Entries[index].Path, Done: true}
+	if err := j.save(); err != nil {
+		return err
+	}
+	return os.RemoveAll(j.backupDir(index))
+}
+
+// restore puts the original files of an entry back in place and removes the
+// merged files, or shards, that were not among them.
+func (j *journal) restore(index int) error {
+	entry := j.Entries[index]
+	if entry.Output == "" {
+		return nil
+	}
+
+	outputPath := filepath.Join(j.baseDir, entry.Output)
+	tx := &packageTransaction{
+		outputPaths: []string{outputPath},
+		originals:   make(map[string]originalFile),
+	}
+	if entry.Sharded {
+		matches, err := filepath.Glob(strings.TrimSuffix(outputPath, ".go") + "_*.go")
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			if isShardOf(match, outputPath) {
+				tx.outputPaths = append(tx.outputPaths, match)
+			}
+		}
+	}
+	for _, rel := range entry.Files {
+		backupPath := filepath.Join(j.backupDir(index), filepath.Base(rel))
+
+		stat, err := os.Stat(backupPath)
+		if err != nil {
+			return fmt.Errorf("missing backup of %s: %w", rel, err)
+		}
+		data, err := os.ReadFile(backupPath)
+		if err != nil {
+			return fmt.Errorf("failed to read backup of %s: %w", rel, err)
+		}
+
+		filePath := filepath.Join(j.baseDir, rel)
+		tx.originals[filePath] = originalFile{data: data, mode: stat.Mode().Perm()}
+		tx.order = append(tx.order, filePath)
+	}
+
+	if err := tx.Rollback(); err != nil {
+		return err
+	}
+	if err := forgetManifest(filepath.Join(j.baseDir, entry.Path), filepath.Base(entry.Output)); err != nil {
+		return err
+	}
+	return syncDir(filepath.Join(j.baseDir, entry.Path))
+}
+
+// remove deletes the journal and the backups.
+func (j *journal) remove() error {
+	if err := os.RemoveAll(filepath.Join(j.baseDir, JournalDir)); err != nil {
+		return fmt.Errorf("failed to remove journal: %w", err)
+	}
+	return syncDir(j.baseDir)
+}
+
+// backupDir returns the directory holding the backups of an entry.
+func (j *journal) backupDir(index int) string {
+	return filepath.Join(j.baseDir, JournalDir, strconv.Itoa(index))
+}
+
+// Recover deals with a squish run of config.BaseDir that was interrupted,
+// e.g. because the generator was killed. It does nothing if no journal is
+// found.
+func Recover(config SquishingConfig, mode RecoveryMode) error {
+	config.BaseDir = filepath.Clean(config.BaseDir)
+
+	j, err := loadJournal(config.BaseDir)
+	if err != nil {
+		return err
+	}
+	if j == nil {
+		if config.VerboseLogging {
+			log.Printf("entsquish: no interrupted run found in %s", config.BaseDir)
+		}
+		return nil
+	}
+
+	if mode != RecoverRollback && mode != RecoverFinish {
+		return fmt.Errorf("unknown recovery mode %d", mode)
+	}
+
+	// Undo the packages in the reverse order they were started
+	for i := len(j.Entries) - 1; i >= 0; i-- {
+		entry := j.Entries[i]
+		if mode == RecoverFinish && entry.Done {
+			continue
+		}
+
+		if config.VerboseLogging {
+			log.Printf("entsquish: restoring package %s", filepath.Join(config.BaseDir, entry.Path))
+		}
+		if err := j.restore(i); err != nil {
+			return fmt.Errorf("failed to restore package %s: %w", entry.Path, err)
+		}
+	}
+
+	if err := j.remove(); err != nil {
+		return err
+	}
+
+	if mode == RecoverFinish {
+		_, err := squishPackages(config)
+		return err
+	}
+	return nil
+}
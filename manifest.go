@@ -0,0 +1,452 @@
+package entsquish
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"time"
+)
+
+// ManifestFileName is the name of the manifest written to every squished
+// directory. It records where each merged declaration came from, so that
+// Unsquish can restore the original files.
+const ManifestFileName = ".entsquish.json"
+
+// manifestVersion is the version of the manifest format.
+const manifestVersion = 1
+
+// modulePath is the module path of entsquish, used to find its version.
+const modulePath = "github.com/codelite7/entsquish"
+
+// Manifest describes the merged files of a directory.
+type Manifest struct {
+	// Version is the manifest format version
+	Version int `json:"version"`
+
+	// Outputs lists the merged files of the directory
+	Outputs []ManifestOutput `json:"outputs"`
+}
+
+// ManifestOutput describes a merged file and the files it replaced.
+type ManifestOutput struct {
+	// Output is the name of the merged file
+	Output string `json:"output"`
+
+	// SHA256 is the hex encoded checksum of the merged file as written. It
+	// is empty for a sharded output, whose shards have checksums of their own.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Shards lists the files the merged file was split into, in order, if
+	// the package was sharded. Output is then the name they are numbered after.
+	Shards []ManifestShard `json:"shards,omitempty"`
+
+	// Entsquish is the version of entsquish that wrote the merged file
+	Entsquish string `json:"entsquish"`
+
+	// Options are the settings the package was merged with
+	Options ManifestOptions `json:"options"`
+
+	// Stats are the statistics of the merge
+	Stats MergeStats `json:"stats"`
+
+	// Files are the original files, in merge order
+	Files []SourceFile `json:"files"`
+
+	// Aliases lists the imports whose name changed in the merge, e.g. to
+	// resolve two packages named sql
+	Aliases []ImportAlias `json:"aliases,omitempty"`
+
+	// Declarations lists the declarations of the merged file in order,
+	// leaving out imports
+	Declarations []DeclarationOrigin `json:"declarations"`
+}
+
+// ManifestOptions records the settings a package was merged with.
+type ManifestOptions struct {
+	// Strategy is the merge strategy selected by the policy
+	Strategy MergeStrategy `json:"strategy,omitempty"`
+
+	// ConflictPolicy is the conflict policy, e.g. "rename"
+	ConflictPolicy string `json:"conflict_policy"`
+
+	// Verify tells whether the merged package was type-checked
+	Verify bool `json:"verify"`
+
+	// MaxFileSize is the size limit for the original files, in bytes
+	MaxFileSize int64 `json:"max_file_size"`
+
+	// LineDirectives tells whether //line directives were emitted
+	LineDirectives bool `json:"line_directives"`
+
+	// TargetFileSize and TargetFileLines are the budget of a shard
+	TargetFileSize  int64 `json:"target_file_size,omitempty"`
+	TargetFileLines int   `json:"target_file_lines,omitempty"`
+}
+
+// ManifestShard describes one of the files a sharded package was split into.
+type ManifestShard struct {
+	// Name is the file name, e.g. gen_2.go
+	Name string `json:"name"`
+
+	// SHA256 is the hex encoded checksum of the file as written
+	SHA256 string `json:"sha256"`
+
+	// Declarations are the indexes in ManifestOutput.Declarations of the
+	// declarations of the file, in the order they appear in it
+	Declarations []int `json:"declarations"`
+}
+
+// SourceFile describes an original file.
+type SourceFile struct {
+	// Name is the file name
+	Name string `json:"name"`
+
+	// Preamble holds the comments above the package clause, such as the
+	// "Code generated" header and build constraints
+	Preamble string `json:"preamble,omitempty"`
+
+	// Imports are the imports of the file as written
+	Imports []SourceImport `json:"imports,omitempty"`
+
+	// Comments are the comments of the file that belong to no declaration,
+	// e.g. go:generate directives
+	Comments []string `json:"comments,omitempty"`
+}
+
+// SourceImport is an import of an original file.
+type SourceImport struct {
+	// Name is the explicit import name, if any
+	Name string `json:"name,omitempty"`
+
+	// Path is the import path
+	Path string `json:"path"`
+
+	// Ident is the name the file's code uses for the package
+	Ident string `json:"ident,omitempty"`
+
+	// Group numbers the blank line separated groups of the import block
+	Group int `json:"group,omitempty"`
+}
+
+// ImportAlias records an import that the code of some original files
+// referred to by another name.
+type ImportAlias struct {
+	// Path is the import path
+	Path string `json:"path"`
+
+	// Name is the name the merged file uses for the package
+	Name string `json:"name"`
+
+	// Files are the original files whose references were renamed to Name
+	Files []string `json:"files"`
+}
+
+// DeclarationOrigin records the file a merged declaration came from.
+type DeclarationOrigin struct {
+	// Name identifies the declaration, e.g. "func:Validate"
+	Name string `json:"name"`
+
+	// File is the original file of the declaration
+	File string `json:"file"`
+
+	// StartLine and EndLine are the lines the declaration, including its
+	// comments, spanned in File
+	StartLine int `json:"start_line"`
+	EndLine   int `json:"end_line"`
+
+	// Duplicates lists the other files that held an identical copy
+	Duplicates []string `json:"duplicates,omitempty"`
+}
+
+// ReadManifest reads the manifest of dir. It returns nil if dir has none.
+func ReadManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest of %s: %w", dir, err)
+	}
+	if manifest.Version != manifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d in %s", manifest.Version, dir)
+	}
+	return &manifest, nil
+}
+
+// Output returns the entry for the merged file name, or nil.
+func (m *Manifest) Output(name string) *ManifestOutput {
+	for i := range m.Outputs {
+		if m.Outputs[i].Output == name {
+			return &m.Outputs[i]
+		}
+	}
+	return nil
+}
+
+// setOutput adds or replaces the entry for output.Output.
+func (m *Manifest) setOutput(output ManifestOutput) {
+	if existing := m.Output(output.Output); existing != nil {
+		*existing = output
+		return
+	}
+	m.Outputs = append(m.Outputs, output)
+}
+
+// removeOutput drops the entry for the merged file name.
+func (m *Manifest) removeOutput(name string) {
+	for i := range m.Outputs {
+		if m.Outputs[i].Output == name {
+			m.Outputs = append(m.Outputs[:i], m.Outputs[i+1:]...)
+			return
+		}
+	}
+}
+
+// mergedFiles returns the names of the files output was written to: the
+// merged file, or its shards.
+func (output ManifestOutput) mergedFiles() []string {
+	if len(output.Shards) == 0 {
+		return []string{output.Output}
+	}
+	var names []string
+	for _, shard := range output.Shards {
+		names = append(names, shard.Name)
+	}
+	return names
+}
+
+// staleFiles returns the merged files of output that are stale, and whether
+// output is. Once the generator wrote the original files in dir again, the
+// merged files would be merged with them. Those named like an original file
+// were written over by the generator, and are not stale.
+func (output ManifestOutput) staleFiles(dir string) ([]string, bool) {
+	merged := output.mergedFiles()
+	regenerated := false
+	sources := make(map[string]bool)
+	for _, source := range output.Files {
+		sources[source.Name] = true
+		if slices.Contains(merged, source.Name) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, source.Name)); err == nil {
+			regenerated = true
+		}
+	}
+	if !regenerated {
+		return nil, false
+	}
+
+	var stale []string
+	for _, name := range merged {
+		if !sources[name] {
+			stale = append(stale, name)
+		}
+	}
+	return stale, true
+}
+
+// write saves the manifest to dir, or removes it once it is empty.
+func (m *Manifest) write(dir string) error {
+	manifestPath := filepath.Join(dir, ManifestFileName)
+	if len(m.Outputs) == 0 {
+		if err := os.Remove(manifestPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove manifest: %w", err)
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	data = append(data, '\n')
+
+	if current, err := os.ReadFile(manifestPath); err == nil && bytes.Equal(current, data) {
+		return nil
+	}
+	if err := writeFileAtomic(manifestPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// forgetManifest drops the merged file name from the manifest of dir, after
+// the package was restored.
+func forgetManifest(dir, name string) error {
+	manifest, err := ReadManifest(dir)
+	if err != nil || manifest == nil {
+		return err
+	}
+
+	manifest.removeOutput(name)
+	return manifest.write(dir)
+}
+
+// manifestDirs returns the directories under baseDir that hold a manifest.
+func manifestDirs(baseDir string) ([]string, error) {
+	var dirs []string
+	err := filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == JournalDir {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && info.Name() == ManifestFileName {
+			dirs = append(dirs, filepath.Dir(path))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk %s: %w", baseDir, err)
+	}
+	return dirs, nil
+}
+
+// mergedFileTime is a merged file holding the content its manifest records,
+// with its modification time.
+type mergedFileTime struct {
+	path    string
+	sha256  string
+	modTime time.Time
+}
+
+// mergedFileTimes returns the merged files under baseDir that hold the
+// content their manifest records. Files that cannot be read are left out.
+func mergedFileTimes(baseDir string) []mergedFileTime {
+	dirs, err := manifestDirs(baseDir)
+	if err != nil {
+		return nil
+	}
+
+	var files []mergedFileTime
+	for _, dir := range dirs {
+		manifest, err := ReadManifest(dir)
+		if err != nil || manifest == nil {
+			continue
+		}
+		for _, output := range manifest.Outputs {
+			parts := output.Shards
+			if len(parts) == 0 {
+				parts = []ManifestShard{{Name: output.Output, SHA256: output.SHA256}}
+			}
+			for _, part := range parts {
+				path := filepath.Join(dir, part.Name)
+				content, err := os.ReadFile(path)
+				if err != nil || checksum(content) != part.SHA256 {
+					continue
+				}
+				if info, err := os.Stat(path); err == nil {
+					files = append(files, mergedFileTime{path: path, sha256: part.SHA256, modTime: info.ModTime()})
+				}
+			}
+		}
+	}
+	return files
+}
+
+// restoreModTimes puts back the modification time of the files that hold
+// the same content again, after the generator and the merge wrote them.
+func restoreModTimes(files []mergedFileTime) error {
+	for _, file := range files {
+		content, err := os.ReadFile(file.path)
+		if err != nil || checksum(content) != file.sha256 {
+			continue
+		}
+		if err := os.Chtimes(file.path, time.Time{}, file.modTime); err != nil {
+			return fmt.Errorf("failed to restore modification time of %s: %w", file.path, err)
+		}
+	}
+	return nil
+}
+
+// removeStaleOutputs removes the stale merged files of dir, see staleFiles,
+// and drops them from its manifest. It returns the names of the removed files.
+func removeStaleOutputs(dir string) ([]string, error) {
+	manifest, err := ReadManifest(dir)
+	if err != nil || manifest == nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, output := range slices.Clone(manifest.Outputs) {
+		stale, ok := output.staleFiles(dir)
+		if !ok {
+			continue
+		}
+		for _, name := range stale {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+				return removed, fmt.Errorf("failed to remove stale file %s: %w", name, err)
+			}
+			removed = append(removed, name)
+		}
+		manifest.removeOutput(output.Output)
+	}
+	return removed, manifest.write(dir)
+}
+
+// checksum returns the hex encoded SHA-256 of content.
+func checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// Version returns the version of entsquish from the build information of
+// the running binary, or "(devel)" if it is unknown.
+func Version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(devel)"
+	}
+	if info.Main.Path == modulePath && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			if dep.Replace != nil && dep.Replace.Version != "" {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return "(devel)"
+}
+
+// recordManifest stores the provenance of a merged file in the manifest of
+// its directory. The entries of earlier merged files it was merged from are
+// dropped, since those files are gone.
+func recordManifest(dir string, output ManifestOutput) error {
+	manifest, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		manifest = &Manifest{Version: manifestVersion}
+	}
+
+	for _, existing := range slices.Clone(manifest.Outputs) {
+		if existing.Output == output.Output {
+			continue
+		}
+		for _, name := range existing.mergedFiles() {
+			if slices.ContainsFunc(output.Files, func(source SourceFile) bool { return source.Name == name }) {
+				manifest.removeOutput(existing.Output)
+				break
+			}
+		}
+	}
+
+	manifest.setOutput(output)
+	return manifest.write(dir)
+}
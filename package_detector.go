@@ -2,43 +2,70 @@ package entsquish
 
 import (
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 )
 
 // PackageDetector identifies packages that can be safely squished.
 type PackageDetector struct {
 	verboseLogging bool
 	config         SquishingConfig
+
+	// mu serializes calls to FindSquishablePackages, which record skipped
+	mu      sync.Mutex
+	skipped []SkippedPackage
+
+	// staleDirs are the directories holding stale merged files, see
+	// ManifestOutput.staleFiles
+	staleDirs []string
 }
 
 // NewPackageDetector creates a new package detector.
 func NewPackageDetector(verboseLogging bool, maxFileSize int64) *PackageDetector {
 	config := DefaultSquishingConfig()
+	config.VerboseLogging = verboseLogging
 	config.MaxFileSize = maxFileSize
+	return NewPackageDetectorFromConfig(config)
+}
+
+// NewPackageDetectorFromConfig creates a new package detector that scans
+// config.BaseDir.
+func NewPackageDetectorFromConfig(config SquishingConfig) *PackageDetector {
+	config.BaseDir = filepath.Clean(config.BaseDir)
 	return &PackageDetector{
-		verboseLogging: verboseLogging,
+		verboseLogging: config.VerboseLogging,
 		config:         config,
 	}
 }
 
 // FindSquishablePackages finds all packages that can be safely squished.
 func (pd *PackageDetector) FindSquishablePackages() ([]SquishablePackage, error) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+
 	var squishablePackages []SquishablePackage
+	pd.skipped = nil
+	pd.staleDirs = nil
 
 	// First, analyze the root gen directory itself for files that can be squished
 	if pd.verboseLogging {
 		log.Printf("entsquish: analyzing root directory: %s", pd.config.BaseDir)
 	}
 
-	rootPkg, shouldSquish, err := pd.analyzeDirectory(pd.config.BaseDir)
+	rootPkgs, err := pd.analyzeDirectory(pd.config.BaseDir)
 	if err != nil {
-		if pd.verboseLogging {
-			log.Printf("entsquish: warning: failed to analyze root directory %s: %v", pd.config.BaseDir, err)
-		}
-	} else if shouldSquish {
+		pd.skip(pd.config.BaseDir, fmt.Sprintf("failed to analyze directory: %v", err))
+	}
+	for _, rootPkg := range rootPkgs {
 		squishablePackages = append(squishablePackages, rootPkg)
 		if pd.verboseLogging {
 			log.Printf("entsquish: found squishable root package: %s (%d files)", rootPkg.Path, len(rootPkg.Files))
@@ -56,21 +83,24 @@ func (pd *PackageDetector) FindSquishablePackages() ([]SquishablePackage, error)
 			return nil
 		}
 
+		// Skip the journal of a run in progress
+		if info.Name() == JournalDir {
+			return filepath.SkipDir
+		}
+
 		// Skip the root gen directory itself (we already analyzed it above)
 		if path == pd.config.BaseDir {
 			return nil
 		}
 
 		// Analyze this directory
-		pkg, shouldSquish, err := pd.analyzeDirectory(path)
+		pkgs, err := pd.analyzeDirectory(path)
 		if err != nil {
-			if pd.verboseLogging {
-				log.Printf("entsquish: warning: failed to analyze directory %s: %v", path, err)
-			}
+			pd.skip(path, fmt.Sprintf("failed to analyze directory: %v", err))
 			return nil // Continue with other directories
 		}
 
-		if shouldSquish {
+		for _, pkg := range pkgs {
 			squishablePackages = append(squishablePackages, pkg)
 			if pd.verboseLogging {
 				log.Printf("entsquish: found squishable package: %s (%d files)", pkg.Path, len(pkg.Files))
@@ -87,48 +117,412 @@ func (pd *PackageDetector) FindSquishablePackages() ([]SquishablePackage, error)
 	return squishablePackages, nil
 }
 
-// analyzeDirectory analyzes a directory to determine if it should be squished.
-func (pd *PackageDetector) analyzeDirectory(dirPath string) (SquishablePackage, bool, error) {
-	pkg := SquishablePackage{
-		Path: dirPath,
+// Skipped returns the packages the last call to FindSquishablePackages left
+// alone, with the reason why.
+func (pd *PackageDetector) Skipped() []SkippedPackage {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	return append([]SkippedPackage(nil), pd.skipped...)
+}
+
+// stale returns the directories in which the last call to
+// FindSquishablePackages found merged files of an earlier squish whose
+// original files were generated again. Those files were left out.
+func (pd *PackageDetector) stale() []string {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	return append([]string(nil), pd.staleDirs...)
+}
+
+// skip records that the package at path is not squished.
+func (pd *PackageDetector) skip(path, reason string) {
+	if pd.verboseLogging {
+		log.Printf("entsquish: skipping %s: %s", path, reason)
+	}
+	pd.skipped = append(pd.skipped, SkippedPackage{Path: path, Reason: reason})
+}
+
+// analyzeDirectory analyzes a directory and returns the file groups in it
+// that should be squished. Files are grouped by build constraint, since
+// only files built under the same constraint can share a file.
+func (pd *PackageDetector) analyzeDirectory(dirPath string) ([]SquishablePackage, error) {
+	relPath, err := filepath.Rel(pd.config.BaseDir, dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Consult the policy before looking at the files
+	if !pd.config.Policy.Allows(relPath) {
+		pd.skip(dirPath, "excluded by policy")
+		return nil, nil
+	}
+
+	rule := pd.config.Policy.Rule(relPath)
+	if rule.Strategy == StrategySkip {
+		pd.skip(dirPath, fmt.Sprintf("policy strategy is %q", rule.Strategy))
+		return nil, nil
 	}
 
 	// Get package type
 	pkgType := pd.classifyPackage(dirPath)
 
-	if pkgType != PackageTypeEntity && pkgType != PackageTypeRoot {
-		if pd.verboseLogging {
-			log.Printf("entsquish: skipping %s package: %s", pkgType.String(), dirPath)
+	if pkgType != PackageTypeEntity && pkgType != PackageTypeRoot && rule.Strategy != StrategyMerge {
+		pd.skip(dirPath, fmt.Sprintf("%s package", pkgType.String()))
+		return nil, nil
+	}
+
+	// List Go files in the directory, setting test files apart
+	goFiles, err := pd.listGoFiles(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	stale, err := pd.staleFiles(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var files, testFiles []string
+	for _, file := range goFiles {
+		if stale[file] {
+			pd.skip(filepath.Join(dirPath, file), "merged file of an earlier squish, its original files were generated again")
+		} else if strings.HasSuffix(file, "_test.go") {
+			testFiles = append(testFiles, file)
+		} else {
+			files = append(files, file)
 		}
-		return pkg, false, nil
 	}
 
-	// List Go files in the directory
-	files, err := pd.listGoFiles(dirPath)
+	// Hand-written files must never be merged, or deleted
+	files, err = pd.generatedFiles(dirPath, relPath, files)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, constraints, err := pd.groupByBuildConstraint(dirPath, files)
 	if err != nil {
-		return pkg, false, err
+		return nil, err
+	}
+
+	var candidates []SquishablePackage
+	for _, constraint := range constraints {
+		pkg := SquishablePackage{
+			Path:            dirPath,
+			Files:           groups[constraint],
+			Strategy:        rule.Strategy,
+			OutputFile:      rule.Output,
+			BuildConstraint: constraint,
+		}
+
+		// Handle root directory differently than entity directories
+		if pkgType == PackageTypeRoot {
+			// For root directory, we don't expect specific entity/where files
+			pkg.EntityName = "gen" // Use "gen" as the entity name for the root package
+			pkg.HasEntityFile = len(pkg.Files) > 0
+			pkg.HasWhereFile = false // Root package doesn't have where files
+		} else {
+			// Determine entity name from directory path for entity packages
+			pkg.EntityName = pd.extractEntityName(dirPath)
+
+			// Check for expected files
+			pkg.HasEntityFile, pkg.HasWhereFile = pd.checkExpectedFiles(pkg.Files, pkg.EntityName)
+		}
+
+		// When a directory mixes build constraints, the constrained groups
+		// are merged into files of their own next to the regular output
+		if len(constraints) > 1 && constraint != "" {
+			pkg.Strategy = StrategyMerge
+			pkg.OutputFile = constrainedFileName(pd.outputBaseName(pkg, rule), constraint)
+		}
+
+		if pkgType == PackageTypeRoot && pkg.Strategy == StrategyPerEntity {
+			candidates = append(candidates, pd.splitByEntity(pkg)...)
+			continue
+		}
+		candidates = append(candidates, pkg)
+	}
+
+	// Test files are only merged on request, among themselves
+	if pd.config.MergeTests && len(testFiles) > 0 {
+		testFiles, err = pd.generatedFiles(dirPath, relPath, testFiles)
+		if err != nil {
+			return nil, err
+		}
+		entityName := "gen"
+		if pkgType != PackageTypeRoot {
+			entityName = pd.extractEntityName(dirPath)
+		}
+		testPkgs, err := pd.testPackages(dirPath, entityName, pd.outputBaseName(SquishablePackage{EntityName: entityName}, rule), testFiles)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, testPkgs...)
+	} else if pd.verboseLogging && len(testFiles) > 0 {
+		log.Printf("entsquish: leaving %d test files of %s alone", len(testFiles), dirPath)
 	}
 
-	pkg.Files = files
+	var pkgs []SquishablePackage
+	for _, pkg := range candidates {
+		// Decide if this package should be squished
+		shouldSquish := pd.shouldSquishPackage(pkg)
 
-	// Handle root directory differently than entity directories
-	if pkgType == PackageTypeRoot {
-		// For root directory, we don't expect specific entity/where files
-		pkg.EntityName = "gen" // Use "gen" as the entity name for the root package
-		pkg.HasEntityFile = len(files) > 0
-		pkg.HasWhereFile = false // Root package doesn't have where files
-	} else {
-		// Determine entity name from directory path for entity packages
-		pkg.EntityName = pd.extractEntityName(dirPath)
+		// Programmatic filters get the final say
+		if shouldSquish && !pd.config.Policy.Accepts(pkg) {
+			pd.skip(dirPath, "rejected by package filter")
+			shouldSquish = false
+		}
 
-		// Check for expected files
-		pkg.HasEntityFile, pkg.HasWhereFile = pd.checkExpectedFiles(files, pkg.EntityName)
+		if shouldSquish {
+			pkgs = append(pkgs, pkg)
+		}
 	}
 
-	// Decide if this package should be squished
-	shouldSquish := pd.shouldSquishPackage(pkg)
+	return pkgs, nil
+}
 
-	return pkg, shouldSquish, nil
+// testPackages groups the test files of a directory by test package: the
+// files of the package itself are merged into <baseName>_test.go and those
+// of the external package, e.g. "user_test", into
+// <baseName>_external_test.go. Build constraints are honored as for other
+// files.
+func (pd *PackageDetector) testPackages(dirPath, entityName, baseName string, files []string) ([]SquishablePackage, error) {
+	var internal, external []string
+	fileSet := token.NewFileSet()
+	for _, file := range files {
+		astFile, err := parser.ParseFile(fileSet, filepath.Join(dirPath, file), nil, parser.PackageClauseOnly)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse file %s: %w", file, err)
+		}
+		if strings.HasSuffix(astFile.Name.Name, "_test") {
+			external = append(external, file)
+		} else {
+			internal = append(internal, file)
+		}
+	}
+
+	var pkgs []SquishablePackage
+	for _, group := range []struct {
+		files  []string
+		suffix string
+	}{
+		{internal, "_test.go"},
+		{external, "_external_test.go"},
+	} {
+		if len(group.files) == 0 {
+			continue
+		}
+
+		groups, constraints, err := pd.groupByBuildConstraint(dirPath, group.files)
+		if err != nil {
+			return nil, err
+		}
+		for _, constraint := range constraints {
+			outputFile := baseName + group.suffix
+			if len(constraints) > 1 && constraint != "" {
+				outputFile = strings.TrimSuffix(constrainedFileName(baseName, constraint), ".go") + group.suffix
+			}
+			pkgs = append(pkgs, SquishablePackage{
+				Path:            dirPath,
+				Files:           groups[constraint],
+				EntityName:      entityName,
+				Strategy:        StrategyMerge,
+				OutputFile:      outputFile,
+				BuildConstraint: constraint,
+				Tests:           true,
+			})
+		}
+	}
+	return pkgs, nil
+}
+
+// splitByEntity splits the files of the root package into a package of the
+// files that belong to no entity, which keeps the root output file, followed
+// by one package per entity merged into <entity>.go, in name order.
+func (pd *PackageDetector) splitByEntity(pkg SquishablePackage) []SquishablePackage {
+	entities := pd.rootEntities()
+
+	shared := pkg
+	shared.Files = nil
+	groups := make(map[string][]string)
+	var names []string
+	for _, file := range pkg.Files {
+		entity := rootFileEntity(file, entities)
+		if entity == "" {
+			shared.Files = append(shared.Files, file)
+			continue
+		}
+		if _, exists := groups[entity]; !exists {
+			names = append(names, entity)
+		}
+		groups[entity] = append(groups[entity], file)
+	}
+	sort.Strings(names)
+
+	if pd.verboseLogging {
+		log.Printf("entsquish: grouped the root files by %d entities", len(names))
+	}
+
+	pkgs := []SquishablePackage{shared}
+	for _, entity := range names {
+		hasEntityFile, _ := pd.checkExpectedFiles(groups[entity], entity)
+		pkgs = append(pkgs, SquishablePackage{
+			Path:            pkg.Path,
+			Files:           groups[entity],
+			EntityName:      entity,
+			HasEntityFile:   hasEntityFile,
+			Strategy:        StrategyPerEntity,
+			OutputFile:      entity + ".go",
+			BuildConstraint: pkg.BuildConstraint,
+		})
+	}
+	return pkgs
+}
+
+// rootEntities returns the entities the root files are grouped by: the
+// configured ones, or the directories of the base directory that look like
+// entity packages, before or after they were squished.
+func (pd *PackageDetector) rootEntities() []string {
+	if len(pd.config.Entities) > 0 {
+		return pd.config.Entities
+	}
+
+	entries, err := os.ReadDir(pd.config.BaseDir)
+	if err != nil {
+		return nil
+	}
+	var entities []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(pd.config.BaseDir, entry.Name())
+		files, err := pd.listGoFiles(dir)
+		if err != nil {
+			continue
+		}
+		hasEntityFile, hasWhereFile := pd.checkExpectedFiles(files, entry.Name())
+		if hasEntityFile && (hasWhereFile || mergedWhereFile(dir, entry.Name())) {
+			entities = append(entities, entry.Name())
+		}
+	}
+	return entities
+}
+
+// mergedWhereFile reports whether the manifest of dir records where.go as
+// merged into <entity>.go, which tells a squished entity package apart.
+func mergedWhereFile(dir, entity string) bool {
+	manifest, err := ReadManifest(dir)
+	if err != nil || manifest == nil {
+		return false
+	}
+	output := manifest.Output(entity + ".go")
+	return output != nil && slices.ContainsFunc(output.Files, func(source SourceFile) bool { return source.Name == "where.go" })
+}
+
+// rootFileEntity returns the entity a root file was generated for, e.g.
+// "user" for user_query.go, or "" if it belongs to none. The longest
+// matching entity name wins.
+func rootFileEntity(file string, entities []string) string {
+	var match string
+	for _, entity := range entities {
+		if (file == entity+".go" || strings.HasPrefix(file, entity+"_")) && len(entity) > len(match) {
+			match = entity
+		}
+	}
+	return match
+}
+
+// staleFiles returns the stale merged files of dirPath, see
+// ManifestOutput.staleFiles, and records the directory if there are any.
+func (pd *PackageDetector) staleFiles(dirPath string) (map[string]bool, error) {
+	manifest, err := ReadManifest(dirPath)
+	if err != nil || manifest == nil {
+		return nil, err
+	}
+
+	stale := make(map[string]bool)
+	found := false
+	for _, output := range manifest.Outputs {
+		files, ok := output.staleFiles(dirPath)
+		for _, file := range files {
+			stale[file] = true
+		}
+		found = found || ok
+	}
+	if found {
+		pd.staleDirs = append(pd.staleDirs, dirPath)
+	}
+	return stale, nil
+}
+
+// generatedFiles returns the files of dirPath that were generated: those
+// listed in config.GeneratedFiles or carrying the standard "Code generated
+// ... DO NOT EDIT." marker. The others are recorded as skipped.
+func (pd *PackageDetector) generatedFiles(dirPath, relPath string, files []string) ([]string, error) {
+	listed := make(map[string]bool, len(pd.config.GeneratedFiles))
+	for _, file := range pd.config.GeneratedFiles {
+		listed[path.Clean(file)] = true
+	}
+
+	var generated []string
+	fileSet := token.NewFileSet()
+	for _, file := range files {
+		if listed[path.Join(filepath.ToSlash(relPath), file)] {
+			generated = append(generated, file)
+			continue
+		}
+
+		astFile, err := parser.ParseFile(fileSet, filepath.Join(dirPath, file), nil, parser.PackageClauseOnly|parser.ParseComments)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse file %s: %w", file, err)
+		}
+		if !ast.IsGenerated(astFile) {
+			pd.skip(filepath.Join(dirPath, file), "hand-written file, it has no \"Code generated ... DO NOT EDIT.\" marker")
+			continue
+		}
+		generated = append(generated, file)
+	}
+	return generated, nil
+}
+
+// groupByBuildConstraint groups files by their //go:build expression, along
+// with the constraint implied by a _GOOS or _GOARCH file name suffix. The
+// returned constraints are sorted, with the unconstrained group ("") first.
+func (pd *PackageDetector) groupByBuildConstraint(dirPath string, files []string) (map[string][]string, []string, error) {
+	groups := make(map[string][]string)
+	var constraints []string
+
+	fileSet := token.NewFileSet()
+	for _, file := range files {
+		astFile, err := parser.ParseFile(fileSet, filepath.Join(dirPath, file), nil, parser.PackageClauseOnly|parser.ParseComments)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse file %s: %w", file, err)
+		}
+
+		constraint, err := fileConstraint(astFile, file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("file %s: %w", file, err)
+		}
+
+		if _, exists := groups[constraint]; !exists {
+			constraints = append(constraints, constraint)
+		}
+		groups[constraint] = append(groups[constraint], file)
+	}
+
+	sort.Strings(constraints)
+
+	if pd.verboseLogging && len(constraints) > 1 {
+		log.Printf("entsquish: %s has %d build constraint groups", dirPath, len(constraints))
+	}
+
+	return groups, constraints, nil
+}
+
+// outputBaseName returns the name of the merged file without extension.
+func (pd *PackageDetector) outputBaseName(pkg SquishablePackage, rule PackageRule) string {
+	if rule.Output != "" {
+		return strings.TrimSuffix(rule.Output, ".go")
+	}
+	return pkg.EntityName
 }
 
 // classifyPackage determines the type of package.
@@ -143,21 +537,8 @@ func (pd *PackageDetector) classifyPackage(dirPath string) PackageType {
 		return PackageTypeUnknown
 	}
 
-	// Special packages that should not be squished
-	specialPackages := []string{
-		"entsf", "entsearch", "enttest", "hook", "intercept",
-		"internal", "migrate", "predicate", "privacy", "runtime",
-		"sfsync", "sfreconcile",
-	}
-
-	for _, special := range specialPackages {
-		if relPath == special || strings.HasPrefix(relPath, special+"/") {
-			return PackageTypeSpecial
-		}
-	}
-
 	// Check if it's a direct subdirectory (entity package)
-	if !strings.Contains(relPath, "/") {
+	if !strings.Contains(filepath.ToSlash(relPath), "/") {
 		return PackageTypeEntity
 	}
 
@@ -165,7 +546,7 @@ func (pd *PackageDetector) classifyPackage(dirPath string) PackageType {
 	return PackageTypeSpecial
 }
 
-// listGoFiles lists all .go files in a directory.
+// listGoFiles lists all .go files in a directory, test files included.
 func (pd *PackageDetector) listGoFiles(dirPath string) ([]string, error) {
 	entries, err := os.ReadDir(dirPath)
 	if err != nil {
@@ -213,39 +594,45 @@ func (pd *PackageDetector) checkExpectedFiles(files []string, entityName string)
 
 // shouldSquishPackage determines if a package should be squished.
 func (pd *PackageDetector) shouldSquishPackage(pkg SquishablePackage) bool {
+	// Test files only need something to merge
+	if pkg.Tests {
+		if len(pkg.Files) < 2 {
+			pd.skip(pkg.Path, fmt.Sprintf("test files of %s: has %d files (need at least 2)", pkg.OutputFile, len(pkg.Files)))
+			return false
+		}
+		return true
+	}
+
 	// Handle root package differently
 	if pd.classifyPackage(pkg.Path) == PackageTypeRoot {
 		// For root package, we want to squish if there are multiple Go files
 		if len(pkg.Files) < 2 {
-			if pd.verboseLogging {
-				log.Printf("entsquish: skipping root package %s: has %d files (need at least 2)", pkg.Path, len(pkg.Files))
+			if pkg.Strategy == StrategyPerEntity && pkg.EntityName != "gen" {
+				pd.skip(pkg.Path, fmt.Sprintf("root files of %s: has %d files (need at least 2)", pkg.EntityName, len(pkg.Files)))
+				return false
 			}
+			pd.skip(pkg.Path, fmt.Sprintf("root package has %d files (need at least 2)", len(pkg.Files)))
 			return false
 		}
 		// Root package should be squished if it has multiple Go files
 		return true
 	}
 
-	// For entity packages, use the original logic
-	// Must have exactly 2 files
-	if len(pkg.Files) != 2 {
-		if pd.verboseLogging {
-			log.Printf("entsquish: skipping %s: has %d files (expected 2)", pkg.Path, len(pkg.Files))
+	// Packages the policy explicitly asks to merge only need something to merge
+	if pkg.Strategy == StrategyMerge {
+		if len(pkg.Files) < 2 {
+			pd.skip(pkg.Path, fmt.Sprintf("has %d files (need at least 2)", len(pkg.Files)))
+			return false
 		}
-		return false
+		return true
 	}
 
-	// Must have both entity and where files
+	// Entity packages must have both entity and where files, next to any
+	// number of other files, e.g. from custom templates or stringer
 	if !pkg.HasEntityFile || !pkg.HasWhereFile {
-		if pd.verboseLogging {
-			log.Printf("entsquish: skipping %s: missing expected files (entity=%v, where=%v)",
-				pkg.Path, pkg.HasEntityFile, pkg.HasWhereFile)
-		}
+		pd.skip(pkg.Path, fmt.Sprintf("missing expected files (entity=%v, where=%v)", pkg.HasEntityFile, pkg.HasWhereFile))
 		return false
 	}
 
-	// Additional safety checks could go here
-	// (e.g., file size limits, modification time checks, etc.)
-
 	return true
 }
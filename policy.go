@@ -0,0 +1,263 @@
+package entsquish
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultPolicyFile is the name of the policy file looked up in the module root.
+const DefaultPolicyFile = ".entsquish.yaml"
+
+// MergeStrategy controls how the files of a package are merged.
+type MergeStrategy string
+
+const (
+	// StrategyDefault lets the detector decide based on the package type.
+	StrategyDefault MergeStrategy = ""
+
+	// StrategyMerge merges every file of the package into a single file.
+	StrategyMerge MergeStrategy = "merge"
+
+	// StrategySkip leaves the package untouched.
+	StrategySkip MergeStrategy = "skip"
+
+	// StrategyPerEntity merges the files ent writes to the root package for
+	// each entity into one file per entity, e.g. user.go, user_create.go,
+	// user_query.go, user_update.go and user_delete.go into user.go, and the
+	// remaining files, such as client.go and tx.go, into gen.go. Other
+	// packages are treated as with StrategyDefault.
+	StrategyPerEntity MergeStrategy = "per-entity"
+)
+
+// Validate returns an error if the strategy is unknown.
+func (s MergeStrategy) Validate() error {
+	switch s {
+	case StrategyDefault, StrategyMerge, StrategySkip, StrategyPerEntity:
+		return nil
+	default:
+		return fmt.Errorf("unknown merge strategy %q", s)
+	}
+}
+
+// PackageRule configures a set of packages matched by a glob.
+type PackageRule struct {
+	// Match is a glob matched against the package path relative to the
+	// base directory ("." for the root package). "**" matches any number
+	// of path segments.
+	Match string `yaml:"match"`
+
+	// Strategy is the merge strategy for matching packages.
+	Strategy MergeStrategy `yaml:"strategy,omitempty"`
+
+	// Output is the file name of the merged file, e.g. "user.go".
+	Output string `yaml:"output,omitempty"`
+}
+
+// Policy decides which packages are squished and how.
+type Policy struct {
+	// Include lists globs of package paths to consider. An empty list
+	// includes every package.
+	Include []string `yaml:"include,omitempty"`
+
+	// Exclude lists globs of package paths to leave untouched. Exclusions
+	// win over inclusions.
+	Exclude []string `yaml:"exclude,omitempty"`
+
+	// Packages holds per-package settings. When several rules match a
+	// package, later rules take precedence.
+	Packages []PackageRule `yaml:"packages,omitempty"`
+
+	// DisableDefaults drops the exclusions of DefaultPolicy, e.g. to squish
+	// the predicate package.
+	DisableDefaults bool `yaml:"disable_defaults,omitempty"`
+
+	// filters are programmatic filters registered with WithPackageFilter.
+	filters []func(SquishablePackage) bool
+}
+
+// DefaultPolicy returns the policy used when nothing else is configured.
+// It excludes the packages ent generates that are not entity packages.
+func DefaultPolicy() Policy {
+	return Policy{
+		// "pkg/**" matches pkg itself as well as everything below it.
+		Exclude: []string{
+			"enttest/**", "hook/**", "intercept/**", "internal/**",
+			"migrate/**", "predicate/**", "privacy/**", "runtime/**",
+		},
+	}
+}
+
+// LoadPolicy reads a YAML policy file.
+func LoadPolicy(filePath string) (Policy, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return Policy{}, fmt.Errorf("failed to read policy file %s: %w", filePath, err)
+	}
+
+	var policy Policy
+	if err := yaml.Unmarshal(data, &policy); err != nil {
+		return Policy{}, fmt.Errorf("failed to parse policy file %s: %w", filePath, err)
+	}
+
+	if err := policy.Validate(); err != nil {
+		return Policy{}, fmt.Errorf("invalid policy file %s: %w", filePath, err)
+	}
+
+	return policy, nil
+}
+
+// Validate checks the globs and strategies of the policy.
+func (p Policy) Validate() error {
+	for _, pattern := range append(append([]string{}, p.Include...), p.Exclude...) {
+		if err := validateGlob(pattern); err != nil {
+			return err
+		}
+	}
+	for _, rule := range p.Packages {
+		if err := validateGlob(rule.Match); err != nil {
+			return err
+		}
+		if err := rule.Strategy.Validate(); err != nil {
+			return fmt.Errorf("package rule %q: %w", rule.Match, err)
+		}
+		if rule.Output != "" && (filepath.Base(rule.Output) != rule.Output || !strings.HasSuffix(rule.Output, ".go")) {
+			return fmt.Errorf("package rule %q: output %q must be a .go file name without directories", rule.Match, rule.Output)
+		}
+	}
+	return nil
+}
+
+// Merge returns a policy holding the settings of p followed by those of
+// other, so that rules from other take precedence.
+func (p Policy) Merge(other Policy) Policy {
+	return Policy{
+		Include:  append(append([]string{}, p.Include...), other.Include...),
+		Exclude:  append(append([]string{}, p.Exclude...), other.Exclude...),
+		Packages: append(append([]PackageRule{}, p.Packages...), other.Packages...),
+
+		DisableDefaults: p.DisableDefaults || other.DisableDefaults,
+		filters:         append(append([]func(SquishablePackage) bool{}, p.filters...), other.filters...),
+	}
+}
+
+// WithDefaults returns the policy preceded by DefaultPolicy, unless
+// DisableDefaults is set.
+func (p Policy) WithDefaults() Policy {
+	if p.DisableDefaults {
+		return p
+	}
+	return DefaultPolicy().Merge(p)
+}
+
+// WithFilter returns a copy of the policy with an additional filter. A
+// package is only squished if every filter returns true.
+func (p Policy) WithFilter(filter func(SquishablePackage) bool) Policy {
+	p.filters = append(append([]func(SquishablePackage) bool{}, p.filters...), filter)
+	return p
+}
+
+// Allows reports whether the package at relPath passes the include and
+// exclude globs.
+func (p Policy) Allows(relPath string) bool {
+	relPath = filepath.ToSlash(relPath)
+
+	for _, pattern := range p.Exclude {
+		if matchGlob(pattern, relPath) {
+			return false
+		}
+	}
+
+	if len(p.Include) == 0 {
+		return true
+	}
+
+	for _, pattern := range p.Include {
+		if matchGlob(pattern, relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rule returns the effective rule for the package at relPath.
+func (p Policy) Rule(relPath string) PackageRule {
+	relPath = filepath.ToSlash(relPath)
+
+	rule := PackageRule{Match: relPath}
+	for _, r := range p.Packages {
+		if !matchGlob(r.Match, relPath) {
+			continue
+		}
+		if r.Strategy != StrategyDefault {
+			rule.Strategy = r.Strategy
+		}
+		if r.Output != "" {
+			rule.Output = r.Output
+		}
+	}
+	return rule
+}
+
+// Accepts runs the programmatic filters against pkg.
+func (p Policy) Accepts(pkg SquishablePackage) bool {
+	for _, filter := range p.filters {
+		if !filter(pkg) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateGlob checks that pattern is a well-formed glob.
+func validateGlob(pattern string) error {
+	if pattern == "" {
+		return fmt.Errorf("empty glob pattern")
+	}
+	for _, segment := range strings.Split(pattern, "/") {
+		if segment == "**" {
+			continue
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("invalid glob pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchGlob matches a slash-separated path against a glob where "**"
+// matches zero or more path segments and every other segment follows
+// path.Match.
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// matchSegments matches glob segments against path segments.
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		ok, err := path.Match(pattern[0], name[0])
+		if err != nil || !ok {
+			return false
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
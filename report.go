@@ -0,0 +1,116 @@
+package entsquish
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Report summarizes a squish run.
+type Report struct {
+	// BaseDir is the directory that was squished
+	BaseDir string `json:"base_dir"`
+
+	// DryRun is set when no files were modified
+	DryRun bool `json:"dry_run"`
+
+	// Results holds one entry per package the run tried to merge,
+	// including failed ones
+	Results []*MergeResult `json:"results"`
+
+	// Skipped lists the packages, and hand-written files, the detector left
+	// alone
+	Skipped []SkippedPackage `json:"skipped"`
+
+	// Totals aggregates Results and Skipped
+	Totals ReportTotals `json:"totals"`
+}
+
+// SkippedPackage is a package that was not squished, with the reason why.
+type SkippedPackage struct {
+	// Path is the package directory, or the path of a hand-written file
+	Path string `json:"path"`
+
+	// Reason explains why the package was skipped
+	Reason string `json:"reason"`
+}
+
+// ReportTotals aggregates the results of a run. Sizes and file counts only
+// cover the packages that were merged successfully.
+type ReportTotals struct {
+	// Merged is the number of packages merged successfully
+	Merged int `json:"merged"`
+
+	// Failed is the number of packages whose merge failed
+	Failed int `json:"failed"`
+
+	// Skipped is the number of packages and files that were skipped
+	Skipped int `json:"skipped"`
+
+	// Cached is the number of merged packages that came from the cache
+	Cached int `json:"cached"`
+
+	// FilesBefore is the number of files that were merged
+	FilesBefore int `json:"files_before"`
+
+	// FilesAfter is the number of files they were merged into, counting
+	// every shard
+	FilesAfter int `json:"files_after"`
+
+	// ImportsDeduped is the number of duplicate imports removed
+	ImportsDeduped int `json:"imports_deduped"`
+
+	// OriginalSize is the combined size of the merged files (in bytes)
+	OriginalSize int64 `json:"original_size"`
+
+	// MergedSize is the combined size of the output files (in bytes)
+	MergedSize int64 `json:"merged_size"`
+
+	// SizeReduction is OriginalSize minus MergedSize
+	SizeReduction int64 `json:"size_reduction"`
+}
+
+// addResult records the result of a package merge.
+func (r *Report) addResult(result *MergeResult) {
+	r.Results = append(r.Results, result)
+
+	if !result.Success {
+		r.Totals.Failed++
+		return
+	}
+
+	r.Totals.Merged++
+	if result.Cached {
+		r.Totals.Cached++
+	}
+	r.Totals.FilesBefore += result.Stats.FilesProcessed
+	r.Totals.FilesAfter += len(result.Outputs())
+	r.Totals.ImportsDeduped += result.Stats.ImportsDeduped
+	r.Totals.OriginalSize += result.Stats.OriginalSize
+	r.Totals.MergedSize += result.Stats.MergedSize
+	r.Totals.SizeReduction += result.Stats.SizeReduction
+}
+
+// addSkipped records packages the detector skipped.
+func (r *Report) addSkipped(skipped []SkippedPackage) {
+	r.Skipped = append(r.Skipped, skipped...)
+	r.Totals.Skipped += len(skipped)
+}
+
+// WriteFile writes the report as indented JSON.
+func (r *Report) WriteFile(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+	data = append(data, '\n')
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create report directory: %w", err)
+	}
+	if err := writeFileAtomic(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
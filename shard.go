@@ -0,0 +1,333 @@
+package entsquish
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"hash/fnv"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// shardBoundaryRate makes one declaration name in shardBoundaryRate a
+// preferred place to start a new shard, see packShards.
+const shardBoundaryRate = 8
+
+// shards reports whether pkg is split into files of bounded size rather than
+// merged into a single file.
+func (fm *FileMerger) shards(pkg SquishablePackage) bool {
+	return !pkg.Tests && fm.isRootPackage(pkg) && (fm.config.TargetFileSize > 0 || fm.config.TargetFileLines > 0)
+}
+
+// shardPath returns the path of the n-th shard of outputPath, counting from
+// 1: gen.go is split into gen_1.go, gen_2.go and so on.
+func shardPath(outputPath string, n int) string {
+	return fmt.Sprintf("%s_%d.go", strings.TrimSuffix(outputPath, ".go"), n)
+}
+
+// isShardOf reports whether path is named like a shard of outputPath.
+func isShardOf(path, outputPath string) bool {
+	number, ok := strings.CutPrefix(path, strings.TrimSuffix(outputPath, ".go")+"_")
+	if !ok {
+		return false
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(number, ".go"))
+	return err == nil && n > 0 && path == shardPath(outputPath, n)
+}
+
+// shardUnit is a run of declarations that go into the same shard: a type
+// declaration along with the methods of its types, or any other single
+// declaration.
+type shardUnit struct {
+	// name is the name of the declaration leading the unit
+	name string
+
+	// decls are the indexes of the declarations in the merged file
+	decls []int
+
+	// size and lines measure the declarations as printed
+	size  int
+	lines int
+}
+
+// shardFile splits the merged file of a package into shards of at most
+// TargetFileSize bytes and TargetFileLines lines, returning their paths and
+// contents. A unit larger than the budget gets a shard of its own. The
+// shards are recorded in provenance, along with the declarations of each.
+func (fm *FileMerger) shardFile(outputPath string, content []byte, provenance *ManifestOutput) ([]string, [][]byte, error) {
+	fileSet := token.NewFileSet()
+	file, err := parser.ParseFile(fileSet, outputPath, content, parser.ParseComments)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse merged file: %w", err)
+	}
+
+	// Dot imports and cgo cannot be told apart from the code using them
+	for _, imp := range file.Imports {
+		if (imp.Name != nil && imp.Name.Name == ".") || imp.Path.Value == `"C"` {
+			if fm.verboseLogging {
+				fm.logf("entsquish: warning: not sharding %s, it imports %s", outputPath, imp.Path.Value)
+			}
+			return []string{outputPath}, [][]byte{content}, nil
+		}
+	}
+
+	var decls []ast.Decl
+	for _, decl := range file.Decls {
+		if genDecl, ok := decl.(*ast.GenDecl); ok && genDecl.Tok == token.IMPORT {
+			continue
+		}
+		decls = append(decls, decl)
+	}
+	if len(decls) != len(provenance.Declarations) {
+		return nil, nil, fmt.Errorf("merged file has %d declarations, expected %d", len(decls), len(provenance.Declarations))
+	}
+
+	// Each declaration is copied as printed, along with its comments
+	commentMap := ast.NewCommentMap(fileSet, file, file.Comments)
+	attached := make(map[*ast.CommentGroup]bool)
+	starts := make([]token.Pos, len(decls))
+	ends := make([]token.Pos, len(decls))
+	for i, decl := range decls {
+		starts[i], ends[i] = decl.Pos(), decl.End()
+		for _, group := range commentMap.Filter(decl).Comments() {
+			attached[group] = true
+			starts[i] = min(starts[i], group.Pos())
+			ends[i] = max(ends[i], group.End())
+		}
+	}
+
+	units := fm.shardUnits(decls, provenance.Declarations, func(i int) (int, int) {
+		start, end := fileSet.Position(starts[i]), fileSet.Position(ends[i])
+		return end.Offset - start.Offset + 2, end.Line - start.Line + 2
+	})
+
+	// Every shard repeats the header and, at most, the imports
+	prelude := token.Position{Offset: len(content), Line: fileSet.Position(file.End()).Line}
+	if len(decls) > 0 {
+		prelude = fileSet.Position(starts[0])
+	}
+	shards := fm.packShards(units, prelude.Offset, prelude.Line)
+
+	// Free-standing comments, such as go:generate directives, go first
+	var loose []*ast.CommentGroup
+	for _, group := range file.Comments {
+		if group.Pos() > file.Name.End() && !attached[group] && !fm.insideDecl(file, group, starts, ends) {
+			loose = append(loose, group)
+		}
+	}
+
+	importShards := fm.importShards(file, fileSet, starts, ends, shards)
+
+	// The package doc is only kept in the first shard
+	undocumented := *file
+	undocumented.Doc = nil
+	undocumented.Comments = nil
+	for _, group := range file.Comments {
+		if group != file.Doc {
+			undocumented.Comments = append(undocumented.Comments, group)
+		}
+	}
+
+	var outputPaths []string
+	var contents [][]byte
+	provenance.Shards = nil
+	for n, shard := range shards {
+		var buf bytes.Buffer
+		header := file
+		if n > 0 {
+			header = &undocumented
+		}
+		fm.writeHeader(&buf, fileSet, header, false)
+		fmt.Fprintf(&buf, "package %s\n", file.Name.Name)
+
+		var specs []ast.Spec
+		for _, imp := range file.Imports {
+			if importShards[imp.Path.Value][n] {
+				spec := &ast.ImportSpec{Path: &ast.BasicLit{Kind: token.STRING, Value: imp.Path.Value}}
+				if imp.Name != nil {
+					spec.Name = &ast.Ident{Name: imp.Name.Name}
+				}
+				specs = append(specs, spec)
+			}
+		}
+		if len(specs) > 0 {
+			buf.WriteString("\n")
+			if err := format.Node(&buf, fileSet, &ast.GenDecl{Tok: token.IMPORT, Specs: specs}); err != nil {
+				return nil, nil, fmt.Errorf("failed to print imports: %w", err)
+			}
+			buf.WriteString("\n")
+		}
+
+		if n == 0 {
+			for _, group := range loose {
+				buf.WriteString("\n" + commentText(group) + "\n")
+			}
+		}
+
+		for _, i := range shard {
+			start, end := fileSet.Position(starts[i]).Offset, fileSet.Position(ends[i]).Offset
+			buf.WriteString("\n")
+			buf.Write(content[start:end])
+			buf.WriteString("\n")
+		}
+
+		shardContent, err := format.Source(buf.Bytes())
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to format shard %d: %w", n+1, err)
+		}
+
+		path := shardPath(outputPath, n+1)
+		outputPaths = append(outputPaths, path)
+		contents = append(contents, shardContent)
+		provenance.Shards = append(provenance.Shards, ManifestShard{
+			Name:         filepath.Base(path),
+			SHA256:       checksum(shardContent),
+			Declarations: shard,
+		})
+	}
+	provenance.SHA256 = ""
+
+	if fm.verboseLogging {
+		fm.logf("entsquish: split %s into %d shards", outputPath, len(shards))
+	}
+
+	return outputPaths, contents, nil
+}
+
+// shardUnits groups the declarations of a merged file into units, in the
+// order of their first declaration. measure returns the size and lines of
+// the i-th declaration.
+func (fm *FileMerger) shardUnits(decls []ast.Decl, origins []DeclarationOrigin, measure func(i int) (int, int)) []shardUnit {
+	// Methods join the declaration of their receiver type
+	typeDecls := make(map[string]int)
+	for i, decl := range decls {
+		if genDecl, ok := decl.(*ast.GenDecl); ok && genDecl.Tok == token.TYPE {
+			for _, spec := range genDecl.Specs {
+				typeDecls[spec.(*ast.TypeSpec).Name.Name] = i
+			}
+		}
+	}
+
+	var units []shardUnit
+	unitOf := make(map[int]int)
+	for i, decl := range decls {
+		lead := i
+		if funcDecl, ok := decl.(*ast.FuncDecl); ok && funcDecl.Recv != nil && len(funcDecl.Recv.List) > 0 {
+			if typeDecl, ok := typeDecls[fm.getTypeName(funcDecl.Recv.List[0].Type)]; ok {
+				lead = typeDecl
+			}
+		}
+
+		unit, ok := unitOf[lead]
+		if !ok {
+			unit = len(units)
+			unitOf[lead] = unit
+			units = append(units, shardUnit{name: origins[lead].Name})
+		}
+
+		size, lines := measure(i)
+		units[unit].decls = append(units[unit].decls, i)
+		units[unit].size += size
+		units[unit].lines += lines
+	}
+	return units
+}
+
+// packShards fills shards with units in order, starting a new shard when the
+// next unit would exceed the budget. Once a shard is half full, a unit whose
+// name hashes to a boundary starts a new shard as well. Boundaries depend on
+// names only, so the declarations after the next boundary are cut into the
+// same shards after a regeneration added or removed a declaration, even
+// though those shards may be renumbered. Every shard starts out with the
+// size and lines of the prelude.
+func (fm *FileMerger) packShards(units []shardUnit, preludeSize, preludeLines int) [][]int {
+	var shards [][]int
+	var current []int
+	size, lines := preludeSize, preludeLines
+	for _, unit := range units {
+		if len(current) > 0 && (fm.exceedsTarget(size+unit.size, lines+unit.lines) || (fm.halfFull(size, lines) && isShardBoundary(unit.name))) {
+			shards = append(shards, current)
+			current, size, lines = nil, preludeSize, preludeLines
+		}
+		current = append(current, unit.decls...)
+		size += unit.size
+		lines += unit.lines
+	}
+	if len(current) > 0 || len(shards) == 0 {
+		shards = append(shards, current)
+	}
+	return shards
+}
+
+// exceedsTarget reports whether a shard of the given size is over budget.
+func (fm *FileMerger) exceedsTarget(size, lines int) bool {
+	return (fm.config.TargetFileSize > 0 && int64(size) > fm.config.TargetFileSize) ||
+		(fm.config.TargetFileLines > 0 && lines > fm.config.TargetFileLines)
+}
+
+// halfFull reports whether a shard of the given size uses half its budget.
+func (fm *FileMerger) halfFull(size, lines int) bool {
+	return (fm.config.TargetFileSize > 0 && 2*int64(size) >= fm.config.TargetFileSize) ||
+		(fm.config.TargetFileLines > 0 && 2*lines >= fm.config.TargetFileLines)
+}
+
+// isShardBoundary reports whether a unit named name prefers to start a shard.
+func isShardBoundary(name string) bool {
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	return hash.Sum32()%shardBoundaryRate == 0
+}
+
+// importShards returns, for every import path literal of file, the shards
+// whose declarations use it. Blank imports, and imports nothing refers to,
+// are kept in the first shard.
+func (fm *FileMerger) importShards(file *ast.File, fileSet *token.FileSet, starts, ends []token.Pos, shards [][]int) map[string]map[int]bool {
+	shardOf := make(map[int]int)
+	for n, shard := range shards {
+		for _, i := range shard {
+			shardOf[i] = n
+		}
+	}
+
+	fileInfo := FileInfo{PackageName: file.Name.Name, AST: file, FileSet: fileSet}
+	used := make(map[string]map[int]bool)
+	for ident, reference := range fm.packageReferences(fileInfo, fm.checkFile(fileInfo)) {
+		// Declarations are in position order
+		i := sort.Search(len(ends), func(i int) bool { return ends[i] > ident.Pos() })
+		if i == len(ends) || starts[i] > ident.Pos() {
+			continue
+		}
+		if used[reference.ImportPath] == nil {
+			used[reference.ImportPath] = make(map[int]bool)
+		}
+		used[reference.ImportPath][shardOf[i]] = true
+	}
+
+	for _, imp := range file.Imports {
+		if used[imp.Path.Value] == nil {
+			used[imp.Path.Value] = map[int]bool{0: true}
+		}
+	}
+	return used
+}
+
+// insideDecl reports whether group lies within a declaration of file,
+// imports included. starts and ends delimit the other declarations.
+func (fm *FileMerger) insideDecl(file *ast.File, group *ast.CommentGroup, starts, ends []token.Pos) bool {
+	i := sort.Search(len(ends), func(i int) bool { return ends[i] >= group.End() })
+	if i < len(ends) && starts[i] <= group.Pos() {
+		return true
+	}
+	for _, decl := range file.Decls {
+		if genDecl, ok := decl.(*ast.GenDecl); ok && genDecl.Tok == token.IMPORT &&
+			group.Pos() >= genDecl.Pos() && group.End() <= genDecl.End() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package entsquish
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// sourceImporter type-checks imports from source, like the "source" compiler
+// of go/importer, for the checks of a run. Packages outside the gen tree,
+// which merges do not change, are type-checked once and shared by all checks.
+// Packages in the gen tree are type-checked again by every check, see
+// forCheck.
+type sourceImporter struct {
+	fileSet *token.FileSet
+	baseDir string
+	context build.Context
+
+	mu       sync.Mutex
+	packages map[string]*importedPackage
+}
+
+// importedPackage is a package outside the gen tree, type-checked by the
+// first check importing it.
+type importedPackage struct {
+	once sync.Once
+	pkg  *types.Package
+	err  error
+}
+
+// newSourceImporter creates the importer of a run over the gen tree in
+// baseDir.
+func newSourceImporter(baseDir string) *sourceImporter {
+	if abs, err := filepath.Abs(baseDir); err == nil {
+		baseDir = abs
+	}
+
+	// cgo is not run, packages using it are checked with their pure Go
+	// files instead
+	context := build.Default
+	context.CgoEnabled = false
+
+	return &sourceImporter{
+		fileSet:  token.NewFileSet(),
+		baseDir:  baseDir,
+		context:  context,
+		packages: make(map[string]*importedPackage),
+	}
+}
+
+// forCheck returns the importer of a single check. It type-checks the gen
+// tree packages it imports itself, so that they are read as they are at the
+// time of the check.
+func (s *sourceImporter) forCheck() types.ImporterFrom {
+	return &checkImporter{shared: s, packages: make(map[string]*types.Package)}
+}
+
+// inTree reports whether dir is in the gen tree. Directories that cannot be
+// compared with it are taken to be.
+func (s *sourceImporter) inTree(dir string) bool {
+	rel, err := filepath.Rel(s.baseDir, dir)
+	return err != nil || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// importShared returns a package outside the gen tree, type-checking it with
+// importer if no check did before.
+func (s *sourceImporter) importShared(buildPkg *build.Package, importer types.ImporterFrom) (*types.Package, error) {
+	s.mu.Lock()
+	imported, ok := s.packages[buildPkg.Dir]
+	if !ok {
+		imported = &importedPackage{}
+		s.packages[buildPkg.Dir] = imported
+	}
+	s.mu.Unlock()
+
+	imported.once.Do(func() {
+		imported.pkg, imported.err = s.check(buildPkg, importer)
+	})
+	return imported.pkg, imported.err
+}
+
+// check type-checks an imported package. Like the source importer of
+// go/importer, it returns the package along with its first type error.
+func (s *sourceImporter) check(buildPkg *build.Package, importer types.ImporterFrom) (*types.Package, error) {
+	var files []*ast.File
+	for _, name := range buildPkg.GoFiles {
+		file, err := parser.ParseFile(s.fileSet, filepath.Join(buildPkg.Dir, name), nil, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse file %s: %w", name, err)
+		}
+		files = append(files, file)
+	}
+
+	var firstErr error
+	conf := types.Config{
+		Importer:    importer,
+		FakeImportC: true,
+		Error: func(err error) {
+			if typeErr, ok := err.(types.Error); firstErr == nil && ok && !typeErr.Soft {
+				firstErr = err
+			}
+		},
+	}
+	pkg, _ := conf.Check(buildPkg.ImportPath, s.fileSet, files, nil)
+	if firstErr != nil {
+		return pkg, fmt.Errorf("type-checking package %q failed (%v)", buildPkg.ImportPath, firstErr)
+	}
+	return pkg, nil
+}
+
+// checkImporter is the importer of a single check. It keeps the gen tree
+// packages it type-checked, by directory.
+type checkImporter struct {
+	shared   *sourceImporter
+	packages map[string]*types.Package
+}
+
+// Import implements types.Importer.
+func (c *checkImporter) Import(path string) (*types.Package, error) {
+	return c.ImportFrom(path, "", 0)
+}
+
+// ImportFrom implements types.ImporterFrom.
+func (c *checkImporter) ImportFrom(path, dir string, _ types.ImportMode) (*types.Package, error) {
+	if path == "unsafe" {
+		return types.Unsafe, nil
+	}
+
+	buildPkg, err := c.shared.context.Import(path, dir, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !c.shared.inTree(buildPkg.Dir) {
+		return c.shared.importShared(buildPkg, c)
+	}
+
+	if pkg, ok := c.packages[buildPkg.Dir]; ok {
+		if pkg == nil {
+			return nil, errors.New("import cycle through package " + path)
+		}
+		return pkg, nil
+	}
+	c.packages[buildPkg.Dir] = nil
+	pkg, err := c.shared.check(buildPkg, c)
+	if pkg == nil {
+		delete(c.packages, buildPkg.Dir)
+	} else {
+		c.packages[buildPkg.Dir] = pkg
+	}
+	return pkg, err
+}
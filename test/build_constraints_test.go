@@ -0,0 +1,133 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/codelite7/entsquish"
+)
+
+func TestBuildConstraintGroups(t *testing.T) {
+	baseDir := t.TempDir()
+	header := "// Code generated by ent, DO NOT EDIT.\n\n"
+	writeFile(t, filepath.Join(baseDir, "client.go"), header+"package ent\n\ntype Client struct{}\n")
+	writeFile(t, filepath.Join(baseDir, "tx.go"), header+"package ent\n\ntype Tx struct{}\n")
+	writeFile(t, filepath.Join(baseDir, "debug.go"), "//go:build debug\n\n"+header+"package ent\n\nconst Debug = true\n")
+	writeFile(t, filepath.Join(baseDir, "trace.go"), header+"//go:build debug\n\npackage ent\n\nconst Trace = true\n")
+	writeFile(t, filepath.Join(baseDir, "generate.go"), "//go:build ignore\n\npackage ent\n\n//go:generate go run entc.go\n")
+
+	config := entsquish.DefaultSquishingConfig()
+	config.BaseDir = baseDir
+
+	packages, err := entsquish.NewPackageDetectorFromConfig(config).FindSquishablePackages()
+	if err != nil {
+		t.Fatalf("FindSquishablePackages failed: %v", err)
+	}
+
+	if len(packages) != 2 {
+		t.Fatalf("Expected 2 constraint groups, got %d: %+v", len(packages), packages)
+	}
+
+	plain, debug := packages[0], packages[1]
+	if plain.BuildConstraint != "" || debug.BuildConstraint != "debug" {
+		t.Fatalf("Unexpected constraints %q and %q", plain.BuildConstraint, debug.BuildConstraint)
+	}
+	sort.Strings(debug.Files)
+	if strings.Join(debug.Files, ",") != "debug.go,trace.go" {
+		t.Errorf("Unexpected debug group files: %v", debug.Files)
+	}
+	if debug.OutputFile != "gen_debug_build.go" {
+		t.Errorf("Expected debug group output gen_debug_build.go, got %q", debug.OutputFile)
+	}
+
+	merger := entsquish.NewFileMergerFromConfig(config)
+	for _, pkg := range packages {
+		if _, err := merger.MergePackage(pkg); err != nil {
+			t.Fatalf("MergePackage failed for %q group: %v", pkg.BuildConstraint, err)
+		}
+	}
+
+	entries, err := os.ReadDir(baseDir)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, ",") != ".entsquish.json,gen.go,gen_debug_build.go,generate.go" {
+		t.Errorf("Unexpected files after merge: %v", names)
+	}
+
+	debugCode, err := os.ReadFile(filepath.Join(baseDir, "gen_debug_build.go"))
+	if err != nil {
+		t.Fatalf("Failed to read merged debug file: %v", err)
+	}
+	if !strings.Contains(string(debugCode), "//go:build debug\n") {
+		t.Errorf("Expected constraint line in merged file:\n%s", debugCode)
+	}
+	if strings.Count(string(debugCode), "//go:build") != 1 {
+		t.Errorf("Expected exactly one constraint line in merged file:\n%s", debugCode)
+	}
+
+	genCode, err := os.ReadFile(filepath.Join(baseDir, "gen.go"))
+	if err != nil {
+		t.Fatalf("Failed to read merged file: %v", err)
+	}
+	if strings.Contains(string(genCode), "go:build") || strings.Contains(string(genCode), "Debug") {
+		t.Errorf("Expected constrained code to stay out of gen.go:\n%s", genCode)
+	}
+}
+
+func TestMergeASTsRejectsMixedConstraints(t *testing.T) {
+	fileInfos := parseTestFiles(t, []string{
+		"package ent\n\ntype Client struct{}\n",
+		"//go:build ignore\n\npackage ent\n\nfunc main() {}\n",
+	})
+
+	fm := entsquish.NewFileMerger(false, false, 1000000)
+	if _, err := fm.MergeASTs(fileInfos); err == nil {
+		t.Error("Expected an error when merging files with different build constraints")
+	}
+}
+
+func TestFileNameConstraints(t *testing.T) {
+	baseDir := t.TempDir()
+	writeGenerated(t, filepath.Join(baseDir, "client.go"), "package ent\n\ntype Client struct{}\n")
+	writeGenerated(t, filepath.Join(baseDir, "ent.go"), "package ent\n\ntype Ent struct{}\n")
+	writeGenerated(t, filepath.Join(baseDir, "foo_windows.go"), "package ent\n\nfunc C() string { return \"windows\" }\n")
+	writeGenerated(t, filepath.Join(baseDir, "bar_windows.go"), "package ent\n\nconst Sep = `\\`\n")
+	writeGenerated(t, filepath.Join(baseDir, "foo_linux.go"), "package ent\n\nfunc C() string { return \"linux\" }\n")
+
+	config := entsquish.DefaultSquishingConfig()
+	config.BaseDir = baseDir
+
+	packages, err := entsquish.NewPackageDetectorFromConfig(config).FindSquishablePackages()
+	if err != nil {
+		t.Fatalf("FindSquishablePackages failed: %v", err)
+	}
+	if len(packages) != 2 || packages[1].BuildConstraint != "windows" {
+		t.Fatalf("Expected an unconstrained and a windows group, got %+v", packages)
+	}
+
+	merger := entsquish.NewFileMergerFromConfig(config)
+	for _, pkg := range packages {
+		if _, err := merger.MergePackage(pkg); err != nil {
+			t.Fatalf("MergePackage failed for %q group: %v", pkg.BuildConstraint, err)
+		}
+	}
+
+	if code := readMerged(t, baseDir, "gen.go"); strings.Contains(code, "func C()") {
+		t.Errorf("Expected no platform code in gen.go:\n%s", code)
+	}
+	windows := readMerged(t, baseDir, "gen_windows_build.go")
+	if !strings.HasPrefix(windows, "//go:build windows\n") || !strings.Contains(windows, `return "windows"`) {
+		t.Errorf("Expected the windows files behind an explicit constraint:\n%s", windows)
+	}
+	if code := readMerged(t, baseDir, "foo_linux.go"); !strings.Contains(code, `return "linux"`) {
+		t.Errorf("Expected foo_linux.go to be left alone, got:\n%s", code)
+	}
+}
@@ -0,0 +1,129 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"entgo.io/ent/entc/gen"
+	"github.com/codelite7/entsquish"
+)
+
+func TestCacheSkipsUnchangedPackages(t *testing.T) {
+	cacheDir := t.TempDir()
+	config := entsquish.DefaultSquishingConfig()
+	config.CacheDir = cacheDir
+
+	squish := func(whereFile string) (*entsquish.MergeResult, string) {
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, "user.go"), "package user\n\nimport \"fmt\"\n\nfunc Label() string { return fmt.Sprint(\"user\") }\n")
+		writeFile(t, filepath.Join(dir, "where.go"), whereFile)
+
+		pkg := entsquish.SquishablePackage{
+			Path:          dir,
+			Files:         []string{"user.go", "where.go"},
+			EntityName:    "user",
+			HasEntityFile: true,
+			HasWhereFile:  true,
+		}
+		result, err := entsquish.NewFileMergerFromConfig(config).MergePackage(pkg)
+		if err != nil {
+			t.Fatalf("MergePackage failed: %v", err)
+		}
+		return result, readMerged(t, dir, "user.go")
+	}
+
+	const whereFile = "package user\n\nimport \"fmt\"\n\nfunc ID() string { return fmt.Sprint(1) }\n"
+	first, merged := squish(whereFile)
+	if first.Cached {
+		t.Error("Expected the first merge to miss the cache")
+	}
+
+	second, cached := squish(whereFile)
+	if !second.Cached {
+		t.Error("Expected the second merge to come from the cache")
+	}
+	if cached != merged || second.Stats != first.Stats {
+		t.Errorf("Expected the cached merge to match the first one, got:\n%s", cached)
+	}
+
+	changed, _ := squish("package user\n\nfunc ID() int { return 2 }\n")
+	if changed.Cached {
+		t.Error("Expected a changed file to miss the cache")
+	}
+}
+
+func TestUnchangedOutputIsNotRewritten(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "user.go"), "package user\n\nconst Label = \"user\"\n")
+	writeFile(t, filepath.Join(dir, "where.go"), "package user\n")
+
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(filepath.Join(dir, "user.go"), past, past); err != nil {
+		t.Fatalf("Failed to set modification time: %v", err)
+	}
+
+	pkg := entsquish.SquishablePackage{
+		Path:          dir,
+		Files:         []string{"user.go", "where.go"},
+		EntityName:    "user",
+		HasEntityFile: true,
+		HasWhereFile:  true,
+	}
+	if _, err := entsquish.NewFileMergerFromConfig(entsquish.DefaultSquishingConfig()).MergePackage(pkg); err != nil {
+		t.Fatalf("MergePackage failed: %v", err)
+	}
+
+	stat, err := os.Stat(filepath.Join(dir, "user.go"))
+	if err != nil {
+		t.Fatalf("Failed to stat user.go: %v", err)
+	}
+	if !stat.ModTime().Equal(past) {
+		t.Errorf("Expected user.go to keep its modification time, got %v", stat.ModTime())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "where.go")); !os.IsNotExist(err) {
+		t.Errorf("Expected where.go to be removed, got %v", err)
+	}
+}
+
+func TestRegenerationKeepsModificationTimes(t *testing.T) {
+	baseDir := t.TempDir()
+	generate := gen.GenerateFunc(func(*gen.Graph) error {
+		writeGenerated(t, filepath.Join(baseDir, "client.go"), "package ent\n\ntype Client struct{}\n")
+		writeGenerated(t, filepath.Join(baseDir, "tx.go"), "package ent\n\ntype Tx struct{}\n")
+		writeEntityPackage(t, baseDir, "user")
+		return nil
+	})
+
+	ext, err := entsquish.NewExtension()
+	if err != nil {
+		t.Fatalf("NewExtension failed: %v", err)
+	}
+	graph := &gen.Graph{Config: &gen.Config{Target: baseDir}}
+	if err := ext.Hooks()[0](generate).Generate(graph); err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	merged := []string{filepath.Join(baseDir, "gen.go"), filepath.Join(baseDir, "user", "user.go")}
+	for _, path := range merged {
+		if err := os.Chtimes(path, past, past); err != nil {
+			t.Fatalf("Failed to set modification time: %v", err)
+		}
+	}
+
+	// ent writes the original files again before the squish
+	if err := ext.Hooks()[0](generate).Generate(graph); err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	for _, path := range merged {
+		stat, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", path, err)
+		}
+		if !stat.ModTime().Equal(past) {
+			t.Errorf("Expected %s to keep its modification time, got %v", path, stat.ModTime())
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codelite7/entsquish"
+)
+
+// writeGenTree lays out a gen tree with a root package and a number of
+// entity packages.
+func writeGenTree(t *testing.T, baseDir string, entities int) {
+	t.Helper()
+	for i := range entities {
+		writeEntityPackage(t, baseDir, fmt.Sprintf("entity%02d", i))
+	}
+	writeGenerated(t, filepath.Join(baseDir, "client.go"), "package ent\n\nimport \"fmt\"\n\nfunc Describe() string { return fmt.Sprint(\"client\") }\n")
+	writeGenerated(t, filepath.Join(baseDir, "ent.go"), "package ent\n\nimport \"fmt\"\n\nfunc Name() string { return fmt.Sprint(\"ent\") }\n")
+}
+
+func TestConcurrentSquishIsDeterministic(t *testing.T) {
+	squish := func(concurrency int) (string, *entsquish.Report, string) {
+		baseDir := t.TempDir()
+		writeGenTree(t, baseDir, 16)
+
+		var diff bytes.Buffer
+		dryRun, err := entsquish.NewExtension(
+			entsquish.WithBaseDir(baseDir),
+			entsquish.WithConcurrency(concurrency),
+			entsquish.WithDryRun(true),
+			entsquish.WithDiffWriter(&diff),
+		)
+		if err != nil {
+			t.Fatalf("NewExtension failed: %v", err)
+		}
+		if _, err := dryRun.Squish(); err != nil {
+			t.Fatalf("Squish failed: %v", err)
+		}
+
+		ext, err := entsquish.NewExtension(entsquish.WithBaseDir(baseDir), entsquish.WithConcurrency(concurrency))
+		if err != nil {
+			t.Fatalf("NewExtension failed: %v", err)
+		}
+		report, err := ext.Squish()
+		if err != nil {
+			t.Fatalf("Squish failed: %v", err)
+		}
+		return baseDir, report, diff.String()
+	}
+
+	serialDir, serial, serialDiff := squish(1)
+	concurrentDir, concurrent, concurrentDiff := squish(8)
+
+	if serial.Totals.Merged != 17 || concurrent.Totals != serial.Totals {
+		t.Errorf("Expected matching totals for 17 packages, got %+v and %+v", serial.Totals, concurrent.Totals)
+	}
+	for i, result := range concurrent.Results {
+		rel, _ := filepath.Rel(concurrentDir, result.OutputPath)
+		serialRel, _ := filepath.Rel(serialDir, serial.Results[i].OutputPath)
+		if rel != serialRel {
+			t.Errorf("Result %d: expected %s, got %s", i, serialRel, rel)
+			continue
+		}
+		if merged := readMerged(t, concurrentDir, rel); merged != readMerged(t, serialDir, rel) {
+			t.Errorf("%s differs between serial and concurrent runs", rel)
+		}
+	}
+
+	if concurrentDiff != serialDiff {
+		t.Error("Expected the concurrent diff to match the serial one")
+	}
+}
+
+func TestConcurrentVerify(t *testing.T) {
+	squish := func(concurrency int) (string, *entsquish.Report) {
+		// A module, so that checks only lock the packages they import
+		moduleDir := t.TempDir()
+		writeFile(t, filepath.Join(moduleDir, "go.mod"), "module example.com/app\n\ngo 1.25\n")
+		baseDir := filepath.Join(moduleDir, "ent")
+		for i := range 8 {
+			writeEntityPackage(t, baseDir, fmt.Sprintf("entity%02d", i))
+		}
+		writeGenerated(t, filepath.Join(baseDir, "client.go"), "package ent\n\ntype Client struct{}\n")
+		writeGenerated(t, filepath.Join(baseDir, "labels.go"), "package ent\n\nimport \"example.com/app/ent/entity00\"\n\nconst Label = entity00.Label\n")
+
+		ext, err := entsquish.NewExtension(
+			entsquish.WithBaseDir(baseDir),
+			entsquish.WithConcurrency(concurrency),
+			entsquish.WithVerify(true),
+		)
+		if err != nil {
+			t.Fatalf("NewExtension failed: %v", err)
+		}
+		report, err := ext.Squish()
+		if err != nil {
+			t.Fatalf("Squish failed: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(baseDir, entsquish.JournalDir)); !os.IsNotExist(err) {
+			t.Errorf("Expected the journal to be removed, got %v", err)
+		}
+		return baseDir, report
+	}
+
+	serialDir, serial := squish(1)
+	concurrentDir, concurrent := squish(8)
+
+	if serial.Totals.Merged != 9 || concurrent.Totals != serial.Totals {
+		t.Errorf("Expected matching totals for 9 packages, got %+v and %+v", serial.Totals, concurrent.Totals)
+	}
+	for _, result := range concurrent.Results {
+		rel, _ := filepath.Rel(concurrentDir, result.OutputPath)
+		if merged := readMerged(t, concurrentDir, rel); merged != readMerged(t, serialDir, rel) {
+			t.Errorf("%s differs between serial and concurrent runs", rel)
+		}
+	}
+}
+
+func TestWithConcurrencyRejectsZero(t *testing.T) {
+	if _, err := entsquish.NewExtension(entsquish.WithConcurrency(0)); err == nil {
+		t.Error("Expected WithConcurrency(0) to fail")
+	}
+}
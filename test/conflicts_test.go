@@ -0,0 +1,162 @@
+package test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codelite7/entsquish"
+)
+
+func TestIdenticalDuplicatesAreDropped(t *testing.T) {
+	fileInfos := parseTestFiles(t, []string{
+		`package user
+
+import entsql "entgo.io/ent/dialect/sql"
+
+// Table is the table name.
+const Table = "users"
+
+func Select() *entsql.Selector { return entsql.Select(Table) }
+`,
+		`package user
+
+import "entgo.io/ent/dialect/sql"
+
+const Table = "users" // same value, different comment
+
+func Select() *sql.Selector {
+	return sql.Select(Table)
+}
+`,
+	})
+
+	fm := entsquish.NewFileMerger(false, false, 1000000)
+	merged, err := fm.MergeASTs(fileInfos)
+	if err != nil {
+		t.Fatalf("MergeASTs failed: %v", err)
+	}
+
+	// Import declaration plus one Table and one Select
+	if len(merged.Decls) != 3 {
+		t.Errorf("Expected 3 declarations after dropping identical duplicates, got %d", len(merged.Decls))
+	}
+}
+
+func TestConflictPolicies(t *testing.T) {
+	const entityFile = `package user
+
+// Validate validates the name.
+func Validate(name string) error {
+	return nil
+}
+
+func Check() error { return Validate("") }
+`
+	const whereFile = `package user
+
+import "errors"
+
+// Validate rejects empty names.
+func Validate(name string) error {
+	if name == "" {
+		return errors.New("empty")
+	}
+	return nil
+}
+
+func NameValid(name string) bool { return Validate(name) == nil }
+`
+
+	setup := func(t *testing.T) (entsquish.SquishablePackage, entsquish.SquishingConfig) {
+		baseDir := t.TempDir()
+		writeFile(t, filepath.Join(baseDir, "user", "user.go"), entityFile)
+		writeFile(t, filepath.Join(baseDir, "user", "where.go"), whereFile)
+
+		config := entsquish.DefaultSquishingConfig()
+		config.BaseDir = baseDir
+		pkg := entsquish.SquishablePackage{
+			Path:          filepath.Join(baseDir, "user"),
+			Files:         []string{"user.go", "where.go"},
+			EntityName:    "user",
+			HasEntityFile: true,
+			HasWhereFile:  true,
+		}
+		return pkg, config
+	}
+
+	t.Run("fail", func(t *testing.T) {
+		pkg, config := setup(t)
+		_, err := entsquish.NewFileMergerFromConfig(config).MergePackage(pkg)
+
+		var conflict *entsquish.ConflictError
+		if !errors.As(err, &conflict) {
+			t.Fatalf("Expected a *ConflictError, got %v", err)
+		}
+		if conflict.Signature != "func:Validate" {
+			t.Errorf("Unexpected signature %q", conflict.Signature)
+		}
+		if filepath.Base(conflict.First.Filename) != "user.go" || conflict.First.Line != 4 {
+			t.Errorf("Unexpected first position %s", conflict.First)
+		}
+		if filepath.Base(conflict.Second.Filename) != "where.go" || conflict.Second.Line != 6 {
+			t.Errorf("Unexpected second position %s", conflict.Second)
+		}
+
+		// The package must be left untouched
+		for _, name := range []string{"user.go", "where.go"} {
+			data, err := os.ReadFile(filepath.Join(pkg.Path, name))
+			if err != nil {
+				t.Fatalf("Expected %s to survive a conflict: %v", name, err)
+			}
+			if name == "user.go" && string(data) != entityFile {
+				t.Errorf("Expected %s to be unchanged", name)
+			}
+		}
+	})
+
+	t.Run("keep-first", func(t *testing.T) {
+		pkg, config := setup(t)
+		config.ConflictPolicy = entsquish.ConflictKeepFirst
+		if _, err := entsquish.NewFileMergerFromConfig(config).MergePackage(pkg); err != nil {
+			t.Fatalf("MergePackage failed: %v", err)
+		}
+
+		code := readMerged(t, pkg.Path, "user.go")
+		if strings.Count(code, "func Validate(") != 1 || strings.Contains(code, "empty") {
+			t.Errorf("Expected only the first Validate to survive:\n%s", code)
+		}
+	})
+
+	t.Run("rename", func(t *testing.T) {
+		pkg, config := setup(t)
+		config.ConflictPolicy = entsquish.ConflictRename
+		if _, err := entsquish.NewFileMergerFromConfig(config).MergePackage(pkg); err != nil {
+			t.Fatalf("MergePackage failed: %v", err)
+		}
+
+		code := readMerged(t, pkg.Path, "user.go")
+		for _, fragment := range []string{
+			"func Validate(name string) error {\n\treturn nil",
+			"func Check() error { return Validate(\"\") }",
+			"func ValidateWhere(name string) error {",
+			"func NameValid(name string) bool { return ValidateWhere(name) == nil }",
+		} {
+			if !strings.Contains(code, fragment) {
+				t.Errorf("Expected merged code to contain %q:\n%s", fragment, code)
+			}
+		}
+	})
+}
+
+// readMerged reads a merged file and fails the test if it is missing.
+func readMerged(t *testing.T, dir, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatalf("Failed to read merged file %s: %v", name, err)
+	}
+	return string(data)
+}
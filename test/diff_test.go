@@ -0,0 +1,69 @@
+package test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codelite7/entsquish"
+)
+
+func TestDryRunDiff(t *testing.T) {
+	const entityFile = `// Code generated by ent, DO NOT EDIT.
+
+package user
+
+import "entgo.io/ent/dialect/sql"
+
+func Order() *sql.Selector { return nil }
+`
+	const whereFile = `// Code generated by ent, DO NOT EDIT.
+
+package user
+
+import "database/sql"
+
+func Open() (*sql.DB, error) { return nil, nil }
+`
+
+	baseDir := t.TempDir()
+	writeFile(t, filepath.Join(baseDir, "user", "user.go"), entityFile)
+	writeFile(t, filepath.Join(baseDir, "user", "where.go"), whereFile)
+
+	var diff bytes.Buffer
+	ext, err := entsquish.NewExtension(
+		entsquish.WithBaseDir(baseDir),
+		entsquish.WithDryRun(true),
+		entsquish.WithDiffWriter(&diff),
+	)
+	if err != nil {
+		t.Fatalf("NewExtension failed: %v", err)
+	}
+	if _, err := ext.Squish(); err != nil {
+		t.Fatalf("Squish failed: %v", err)
+	}
+
+	for _, fragment := range []string{
+		"--- a/user/user.go\n+++ b/user/user.go\n",
+		"-import \"entgo.io/ent/dialect/sql\"\n",
+		"+\tentsql \"entgo.io/ent/dialect/sql\"\n",
+		"-func Order() *sql.Selector { return nil }\n+func Order() *entsql.Selector { return nil }\n",
+		"+\tstdsql \"database/sql\"\n",
+		"+func Open() (*stdsql.DB, error) { return nil, nil }\n",
+		"--- a/user/where.go\n+++ /dev/null\n@@ -1,7 +0,0 @@\n-// Code generated by ent, DO NOT EDIT.\n",
+	} {
+		if !strings.Contains(diff.String(), fragment) {
+			t.Errorf("Expected diff to contain %q:\n%s", fragment, diff.String())
+		}
+	}
+
+	// A dry run leaves the files alone
+	if code := readMerged(t, filepath.Join(baseDir, "user"), "where.go"); code != whereFile {
+		t.Errorf("Expected where.go to be unchanged, got:\n%s", code)
+	}
+	if _, err := os.Stat(filepath.Join(baseDir, "user", "user.go")); err != nil {
+		t.Errorf("Expected user.go to be left in place: %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"entgo.io/ent/entc/gen"
+	"github.com/codelite7/entsquish"
+)
+
+func TestResolveBaseDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd failed: %v", err)
+	}
+	// The test binary runs in ./test, one level below the module root.
+	moduleRoot := filepath.Dir(wd)
+
+	tests := []struct {
+		name     string
+		dir      string
+		expected string
+	}{
+		{
+			name:     "absolute path is kept",
+			dir:      "/tmp/project/ent/",
+			expected: "/tmp/project/ent",
+		},
+		{
+			name:     "relative path is resolved against the module root",
+			dir:      "./ent",
+			expected: filepath.Join(moduleRoot, "ent"),
+		},
+		{
+			name:     "nested relative path",
+			dir:      "internal/ent/gen",
+			expected: filepath.Join(moduleRoot, "internal", "ent", "gen"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := entsquish.ResolveBaseDir(tt.dir)
+			if err != nil {
+				t.Fatalf("ResolveBaseDir(%q) failed: %v", tt.dir, err)
+			}
+			if result != tt.expected {
+				t.Errorf("ResolveBaseDir(%q) = %q, want %q", tt.dir, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRelativeTargetFollowsWorkingDirectory(t *testing.T) {
+	moduleDir := t.TempDir()
+	writeFile(t, filepath.Join(moduleDir, "go.mod"), "module example.com/app\n\ngo 1.25\n")
+	writeEntityPackage(t, filepath.Join(moduleDir, "ent", "gen"), "user")
+	writeEntityPackage(t, filepath.Join(moduleDir, "gen"), "user")
+	t.Chdir(filepath.Join(moduleDir, "ent"))
+
+	ext, err := entsquish.NewExtension()
+	if err != nil {
+		t.Fatalf("NewExtension failed: %v", err)
+	}
+	generate := ext.Hooks()[0](gen.GenerateFunc(func(*gen.Graph) error { return nil }))
+	if err := generate.Generate(&gen.Graph{Config: &gen.Config{Target: "./gen"}}); err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(moduleDir, "ent", "gen", "user", "where.go")); !os.IsNotExist(err) {
+		t.Errorf("Expected ent/gen to be squished, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(moduleDir, "gen", "user", "where.go")); err != nil {
+		t.Errorf("Expected the gen directory of the module root to be left alone: %v", err)
+	}
+}
+
+func TestWithBaseDirRejectsEmpty(t *testing.T) {
+	if _, err := entsquish.NewExtension(entsquish.WithBaseDir("")); err == nil {
+		t.Error("Expected an error for an empty base directory")
+	}
+}
+
+func TestExtensionSquish(t *testing.T) {
+	baseDir := t.TempDir()
+	writeEntityPackage(t, baseDir, "user")
+
+	dryRun, err := entsquish.NewExtension(entsquish.WithBaseDir(baseDir), entsquish.WithDryRun(true))
+	if err != nil {
+		t.Fatalf("NewExtension failed: %v", err)
+	}
+	report, err := dryRun.Squish()
+	if err != nil {
+		t.Fatalf("Squish failed: %v", err)
+	}
+	if !report.DryRun || report.Totals.Merged != 1 {
+		t.Errorf("Unexpected dry run report: %+v", report.Totals)
+	}
+	if _, err := os.Stat(filepath.Join(baseDir, "user", "where.go")); err != nil {
+		t.Errorf("Expected a dry run to leave where.go alone: %v", err)
+	}
+
+	ext, err := entsquish.NewExtension(entsquish.WithBaseDir(baseDir))
+	if err != nil {
+		t.Fatalf("NewExtension failed: %v", err)
+	}
+	if _, err := ext.Squish(); err != nil {
+		t.Fatalf("Squish failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(baseDir, "user", "where.go")); !os.IsNotExist(err) {
+		t.Errorf("Expected where.go to be merged away, got %v", err)
+	}
+}
+
+func TestExtensionSquishNeedsBaseDir(t *testing.T) {
+	ext, err := entsquish.NewExtension()
+	if err != nil {
+		t.Fatalf("NewExtension failed: %v", err)
+	}
+	if _, err := ext.Squish(); err == nil {
+		t.Error("Expected Squish without WithBaseDir to fail")
+	}
+}
+
+func TestRegenerateAfterSquish(t *testing.T) {
+	baseDir := t.TempDir()
+
+	// generate writes what ent would for a User schema with the given fields
+	generate := func(fields string) gen.Generator {
+		return gen.GenerateFunc(func(*gen.Graph) error {
+			writeGenerated(t, filepath.Join(baseDir, "client.go"), "package ent\n\ntype Client struct{}\n")
+			writeGenerated(t, filepath.Join(baseDir, "mutation.go"), "package ent\n\ntype UserMutation struct{ "+fields+" }\n")
+			writeGenerated(t, filepath.Join(baseDir, "user.go"), "package ent\n\ntype User struct{ "+fields+" }\n")
+			writeGenerated(t, filepath.Join(baseDir, "user", "user.go"), "package user\n\nconst Fields = \""+fields+"\"\n")
+			writeGenerated(t, filepath.Join(baseDir, "user", "where.go"), "package user\n\nfunc ID() int { return 0 }\n")
+			return nil
+		})
+	}
+
+	ext, err := entsquish.NewExtension()
+	if err != nil {
+		t.Fatalf("NewExtension failed: %v", err)
+	}
+	graph := &gen.Graph{Config: &gen.Config{Target: baseDir}}
+	if err := ext.Hooks()[0](generate("Name string")).Generate(graph); err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+
+	// The schema gains a field, and ent writes the original files again
+	if err := ext.Hooks()[0](generate("Name string; Age int")).Generate(graph); err != nil {
+		t.Fatalf("Generate after the schema change failed: %v", err)
+	}
+
+	entries, err := os.ReadDir(baseDir)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, ",") != ".entsquish.json,gen.go,user" {
+		t.Errorf("Unexpected files after regenerating: %v", names)
+	}
+	code := readMerged(t, baseDir, "gen.go")
+	if strings.Count(code, "type Client struct") != 1 || strings.Count(code, "Age") != 2 {
+		t.Errorf("Expected gen.go to hold the new schema once, got:\n%s", code)
+	}
+	if code := readMerged(t, baseDir, "user/user.go"); !strings.Contains(code, "Age int") || !strings.Contains(code, "func ID()") {
+		t.Errorf("Expected user/user.go to hold the new schema, got:\n%s", code)
+	}
+
+	// The manifest describes the new merge, so it can be undone
+	if err := entsquish.Unsquish(baseDir); err != nil {
+		t.Fatalf("Unsquish failed: %v", err)
+	}
+	if code := readMerged(t, baseDir, "user.go"); !strings.Contains(code, "Age") {
+		t.Errorf("Expected user.go of the new schema to be restored, got:\n%s", code)
+	}
+}
@@ -737,3 +737,369 @@ func test() {
 		}
 	})
 }
+
+func TestMergeASTsPreservesComments(t *testing.T) {
+	sourceFiles := []string{
+		`// Code generated by ent, DO NOT EDIT.
+
+package user
+
+import "errors"
+
+// Label holds the string label denoting the user type in the database.
+const Label = "user"
+
+// Validate checks the user.
+func Validate(name string) error {
+	// Names must not be empty.
+	if name == "" {
+		//nolint:goerr113
+		return errors.New("empty name")
+	}
+	return nil // all good
+}
+`,
+		`// Code generated by ent, DO NOT EDIT.
+
+package user
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Describe returns a description of the user.
+//
+//lint:ignore U1000 used by custom templates
+func Describe(name string) string {
+	/* keep the format in sync with the template */
+	return fmt.Sprintf("user(%s)", name)
+}
+
+// Validate is a duplicate that must be dropped together with this comment.
+func Validate(name string) error {
+	if name == "" {
+		return errors.New("empty name")
+	}
+	return nil
+}
+`,
+		`// Code generated by ent, DO NOT EDIT.
+
+package user
+
+//go:generate echo "free-standing directive"
+`,
+	}
+
+	fileInfos := parseTestFiles(t, sourceFiles)
+	fm := entsquish.NewFileMerger(false, false, 1000000)
+
+	merged, err := fm.MergeASTs(fileInfos)
+	if err != nil {
+		t.Fatalf("MergeASTs failed: %v", err)
+	}
+
+	var buf strings.Builder
+	if err := format.Node(&buf, fileInfos[0].FileSet, merged); err != nil {
+		t.Fatalf("Failed to format merged AST: %v", err)
+	}
+	generatedCode := buf.String()
+	t.Logf("Generated code:\n%s", generatedCode)
+
+	// Comments must stay next to the code they annotate
+	expectedFragments := []string{
+		"// Label holds the string label denoting the user type in the database.\nconst Label = \"user\"",
+		"// Validate checks the user.\nfunc Validate(name string) error {",
+		"\t// Names must not be empty.\n\tif name == \"\" {",
+		"\t\t//nolint:goerr113\n\t\treturn errors.New(\"empty name\")",
+		"return nil // all good",
+		"// Describe returns a description of the user.\n//\n//lint:ignore U1000 used by custom templates\nfunc Describe(name string) string {",
+		"\t/* keep the format in sync with the template */\n\treturn fmt.Sprintf",
+		"//go:generate echo \"free-standing directive\"",
+	}
+	for _, fragment := range expectedFragments {
+		if !strings.Contains(generatedCode, fragment) {
+			t.Errorf("Expected merged code to contain %q", fragment)
+		}
+	}
+
+	if strings.Contains(generatedCode, "must be dropped") {
+		t.Error("Expected the comment of a dropped duplicate declaration to be removed")
+	}
+
+	// Round trip: the printed code must parse and be stable under gofmt
+	formatted, err := format.Source([]byte(generatedCode))
+	if err != nil {
+		t.Fatalf("Merged code does not parse: %v", err)
+	}
+	if string(formatted) != generatedCode {
+		t.Errorf("Merged code is not gofmt-stable:\n%s", formatted)
+	}
+
+	reparsed, err := parser.ParseFile(token.NewFileSet(), "merged.go", formatted, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("Failed to reparse merged code: %v", err)
+	}
+	if len(reparsed.Comments) != len(merged.Comments) {
+		t.Errorf("Expected %d comment groups after round trip, got %d", len(merged.Comments), len(reparsed.Comments))
+	}
+}
+
+func TestTypeCheckedImportRewriting(t *testing.T) {
+	sourceFiles := []string{
+		`package gen
+
+import "database/sql"
+
+type holder struct {
+	sql string
+}
+
+func open(h holder) (*sql.DB, error) {
+	sql := h.sql
+	_ = sql
+	return nil, nil
+}
+
+func nested() error {
+	f := func(sql int) int { return sql + 1 }
+	_ = f
+	{
+		var sql = struct{ DB int }{}
+		_ = sql.DB
+	}
+	go func() {
+		for _, sql := range []holder{} {
+			_ = sql.sql
+		}
+	}()
+	_ = driver.(interface {
+		BeginTx(*sql.TxOptions) error
+	})
+	return sql.ErrNoRows
+}
+`,
+		`package gen
+
+import "entgo.io/ent/dialect/sql"
+
+func selector(s *sql.Selector) *sql.Selector {
+	func() {
+		sql := s
+		_ = sql.Clone
+	}()
+	return sql.Select().From(sql.Table("users"))
+}
+`,
+	}
+
+	fileInfos := parseTestFiles(t, sourceFiles)
+	fm := entsquish.NewFileMerger(false, false, 1000000)
+
+	merged, err := fm.MergeASTs(fileInfos)
+	if err != nil {
+		t.Fatalf("MergeASTs failed: %v", err)
+	}
+
+	var buf strings.Builder
+	if err := format.Node(&buf, fileInfos[0].FileSet, merged); err != nil {
+		t.Fatalf("Failed to format merged AST: %v", err)
+	}
+	generatedCode := buf.String()
+	t.Logf("Generated code:\n%s", generatedCode)
+
+	expectedFragments := []string{
+		// Package references use the merged aliases
+		"func open(h holder) (*stdsql.DB, error) {",
+		"BeginTx(*stdsql.TxOptions) error",
+		"return stdsql.ErrNoRows",
+		"func selector(s *entsql.Selector) *entsql.Selector {",
+		"return entsql.Select().From(entsql.Table(\"users\"))",
+		// Locals, parameters and fields sharing the import's name are untouched
+		"sql := h.sql",
+		"return sql + 1",
+		"_ = sql.DB",
+		"_ = sql.sql",
+		"sql := s",
+		"_ = sql.Clone",
+	}
+	for _, fragment := range expectedFragments {
+		if !strings.Contains(generatedCode, fragment) {
+			t.Errorf("Expected merged code to contain %q", fragment)
+		}
+	}
+}
+
+func TestMergeASTsKeepsInitAndBlankDeclarations(t *testing.T) {
+	sourceFiles := []string{
+		`package ent
+
+import "entgo.io/ent"
+
+var _ ent.Mutation = (*UserMutation)(nil)
+
+func init() { register("user") }
+
+var _ = register("side effect")
+`,
+		`package ent
+
+import "entgo.io/ent"
+
+var _ ent.Mutation = (*PetMutation)(nil)
+
+func init() { register("pet") }
+
+func init() { register("pet edges") }
+
+var _, Version = register("a"), "v1"
+`,
+		`package ent
+
+import "entgo.io/ent"
+
+var _ ent.Mutation = (*UserMutation)(nil)
+
+func init() { register("user") }
+
+func register(name string) string { return name }
+`,
+	}
+
+	fileInfos := parseTestFiles(t, sourceFiles)
+	fm := entsquish.NewFileMerger(false, false, 1000000)
+
+	merged, err := fm.MergeASTs(fileInfos)
+	if err != nil {
+		t.Fatalf("MergeASTs failed: %v", err)
+	}
+
+	var buf strings.Builder
+	if err := format.Node(&buf, fileInfos[0].FileSet, merged); err != nil {
+		t.Fatalf("Failed to format merged AST: %v", err)
+	}
+	generatedCode := buf.String()
+
+	// Every init and blank declaration survives, in the original order,
+	// even when its text repeats
+	expectedOrder := []string{
+		"var _ entpkg.Mutation = (*UserMutation)(nil)",
+		`func init() { register("user") }`,
+		`var _ = register("side effect")`,
+		"var _ entpkg.Mutation = (*PetMutation)(nil)",
+		`func init() { register("pet") }`,
+		`func init() { register("pet edges") }`,
+		`var _, Version = register("a"), "v1"`,
+		"var _ entpkg.Mutation = (*UserMutation)(nil)",
+		`func init() { register("user") }`,
+		"func register(name string) string { return name }",
+	}
+
+	remaining := generatedCode
+	for _, fragment := range expectedOrder {
+		index := strings.Index(remaining, fragment)
+		if index < 0 {
+			t.Fatalf("Expected %q (in order) in merged code:\n%s", fragment, generatedCode)
+		}
+		remaining = remaining[index+len(fragment):]
+	}
+
+	if count := strings.Count(generatedCode, "func init()"); count != 4 {
+		t.Errorf("Expected 4 init functions, got %d", count)
+	}
+}
+
+func TestBlankAndDotImports(t *testing.T) {
+	sourceFiles := []string{
+		`package ent
+
+import (
+	_ "embed"
+	_ "net/http/pprof"
+	. "strings"
+)
+
+//go:embed schema.sql
+var schema string
+
+func upper() string { return ToUpper(schema) }
+`,
+		`package ent
+
+import (
+	"embed"
+	"strings"
+)
+
+//go:embed migrations
+var migrations embed.FS
+
+func lower() string { return strings.ToLower(schema) }
+`,
+	}
+
+	fileInfos := parseTestFiles(t, sourceFiles)
+	fm := entsquish.NewFileMerger(false, false, 1000000)
+
+	merged, err := fm.MergeASTs(fileInfos)
+	if err != nil {
+		t.Fatalf("MergeASTs failed: %v", err)
+	}
+
+	var buf strings.Builder
+	if err := format.Node(&buf, fileInfos[0].FileSet, merged); err != nil {
+		t.Fatalf("Failed to format merged AST: %v", err)
+	}
+	generatedCode := buf.String()
+
+	// A blank import gives way to a named one, a dot import is kept beside it
+	expectedFragments := []string{
+		"\t\"embed\"\n",
+		"\t_ \"net/http/pprof\"\n",
+		"\t\"strings\"\n",
+		"\t. \"strings\"\n",
+		"var migrations embed.FS",
+		"return ToUpper(schema)",
+		"return strings.ToLower(schema)",
+	}
+	for _, fragment := range expectedFragments {
+		if !strings.Contains(generatedCode, fragment) {
+			t.Errorf("Expected merged code to contain %q:\n%s", fragment, generatedCode)
+		}
+	}
+	if strings.Contains(generatedCode, `_ "embed"`) || strings.Contains(generatedCode, "_.FS") {
+		t.Errorf("Expected the blank embed import to be dropped:\n%s", generatedCode)
+	}
+}
+
+func TestPackageDocKeepsInitOrder(t *testing.T) {
+	sourceFiles := []string{
+		"package ent\n\nfunc init() { register(\"a\") }\n",
+		"// Package ent is the generated client.\npackage ent\n\nfunc init() { register(\"user\") }\n\nfunc register(name string) {}\n",
+	}
+
+	fileInfos := parseTestFiles(t, sourceFiles)
+	fm := entsquish.NewFileMerger(false, false, 1000000)
+
+	merged, err := fm.MergeASTs(fileInfos)
+	if err != nil {
+		t.Fatalf("MergeASTs failed: %v", err)
+	}
+
+	var buf strings.Builder
+	if err := format.Node(&buf, fileInfos[0].FileSet, merged); err != nil {
+		t.Fatalf("Failed to format merged AST: %v", err)
+	}
+	generatedCode := buf.String()
+
+	// The package doc comes from the second file, the declarations keep
+	// the order of the files
+	if !strings.HasPrefix(generatedCode, "// Package ent is the generated client.\npackage ent\n") {
+		t.Errorf("Expected the package doc on top:\n%s", generatedCode)
+	}
+	a, user := strings.Index(generatedCode, `register("a")`), strings.Index(generatedCode, `register("user")`)
+	if a < 0 || user < 0 || a > user {
+		t.Errorf("Expected the init of the first file to run first:\n%s", generatedCode)
+	}
+}
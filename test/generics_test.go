@@ -0,0 +1,119 @@
+package test
+
+import (
+	"go/ast"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strings"
+	"testing"
+
+	"github.com/codelite7/entsquish"
+)
+
+func TestMergeGenericDeclarations(t *testing.T) {
+	sourceFiles := []string{
+		// Generic entity types as produced by custom templates
+		`package ent
+
+// Page is a page of results.
+type Page[T any] struct {
+	Items []T
+	next  *Page[T]
+}
+
+// Next returns the following page.
+func (p *Page[T]) Next() *Page[T] { return p.next }
+
+// Len returns the number of items.
+func (p Page[T]) Len() int { return len(p.Items) }
+
+// Edge connects two entities.
+type Edge[K comparable, V any] struct {
+	Key   K
+	Value V
+	next  *Edge[K, V]
+}
+
+// Next returns the following edge.
+func (e *Edge[K, V]) Next() *Edge[K, V] { return e.next }
+`,
+		`package ent
+
+// Cursor walks over nodes.
+type Cursor[T any] struct {
+	nodes []T
+	pos   int
+}
+
+// Next advances the cursor.
+func (c *Cursor[T]) Next() bool {
+	c.pos++
+	return c.pos < len(c.nodes)
+}
+
+// Len returns the number of nodes.
+func (c *(Cursor[T])) Len() int { return len(c.nodes) }
+
+// Map applies fn to every item.
+func Map[T, R any](items []T, fn func(T) R) []R {
+	out := make([]R, 0, len(items))
+	for _, item := range items {
+		out = append(out, fn(item))
+	}
+	return out
+}
+
+// Pair is a non-generic type with a method of the same name.
+type Pair struct{ a, b int }
+
+// Next returns the next pair.
+func (p Pair) Next() Pair { return Pair{p.b, p.a + p.b} }
+`,
+	}
+
+	fileInfos := parseTestFiles(t, sourceFiles)
+	fm := entsquish.NewFileMerger(false, false, 1000000)
+
+	merged, err := fm.MergeASTs(fileInfos)
+	if err != nil {
+		t.Fatalf("MergeASTs failed: %v", err)
+	}
+
+	// Every method survives the merge
+	methods := make(map[string]int)
+	for _, decl := range merged.Decls {
+		if funcDecl, ok := decl.(*ast.FuncDecl); ok && funcDecl.Recv != nil {
+			methods[funcDecl.Name.Name]++
+		}
+	}
+	if methods["Next"] != 4 {
+		t.Errorf("Expected 4 Next methods, got %d", methods["Next"])
+	}
+	if methods["Len"] != 2 {
+		t.Errorf("Expected 2 Len methods, got %d", methods["Len"])
+	}
+
+	var buf strings.Builder
+	if err := format.Node(&buf, fileInfos[0].FileSet, merged); err != nil {
+		t.Fatalf("Failed to format merged AST: %v", err)
+	}
+	generatedCode := buf.String()
+
+	if !strings.Contains(generatedCode, "func Map[T, R any](items []T, fn func(T) R) []R {") {
+		t.Errorf("Expected generic function in merged code:\n%s", generatedCode)
+	}
+
+	// The merged code must type-check
+	fileSet := token.NewFileSet()
+	file, err := parser.ParseFile(fileSet, "ent.go", generatedCode, 0)
+	if err != nil {
+		t.Fatalf("Failed to parse merged code: %v", err)
+	}
+	config := types.Config{Importer: importer.Default()}
+	if _, err := config.Check("ent", fileSet, []*ast.File{file}, nil); err != nil {
+		t.Errorf("Merged code does not type-check: %v\n%s", err, generatedCode)
+	}
+}
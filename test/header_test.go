@@ -0,0 +1,110 @@
+package test
+
+import (
+	"go/format"
+	"strings"
+	"testing"
+
+	"github.com/codelite7/entsquish"
+)
+
+func TestMergeASTsPreservesHeader(t *testing.T) {
+	tests := []struct {
+		name        string
+		sourceFiles []string
+		header      string
+		doc         string
+	}{
+		{
+			name: "generated marker",
+			sourceFiles: []string{
+				`// Code generated by ent, DO NOT EDIT.
+
+package user
+
+const Label = "user"
+`,
+				`// Code generated by ent, DO NOT EDIT.
+
+package user
+
+func ID() int { return 0 }
+`,
+			},
+			header: "// Code generated by ent, DO NOT EDIT.",
+		},
+		{
+			name: "custom header and license",
+			sourceFiles: []string{
+				`// Copyright 2025 Example Inc. All rights reserved.
+
+// Code generated by entc, DO NOT EDIT.
+
+package ent
+
+type Client struct{}
+`,
+				`// Copyright 2025 Example Inc. All rights reserved.
+
+// Code generated by entc, DO NOT EDIT.
+
+package ent
+
+type Tx struct{}
+`,
+			},
+			header: "// Copyright 2025 Example Inc. All rights reserved.\n\n// Code generated by entc, DO NOT EDIT.",
+		},
+		{
+			name: "package doc from a later file",
+			sourceFiles: []string{
+				`// Code generated by ent, DO NOT EDIT.
+
+package ent
+
+type Client struct{}
+`,
+				`// Code generated by ent, DO NOT EDIT.
+
+// Package ent holds the generated client.
+package ent
+
+type Tx struct{}
+`,
+			},
+			header: "// Code generated by ent, DO NOT EDIT.",
+			doc:    "// Package ent holds the generated client.\npackage ent",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileInfos := parseTestFiles(t, tt.sourceFiles)
+			fm := entsquish.NewFileMerger(false, false, 1000000)
+
+			merged, err := fm.MergeASTs(fileInfos)
+			if err != nil {
+				t.Fatalf("MergeASTs failed: %v", err)
+			}
+
+			var buf strings.Builder
+			if err := format.Node(&buf, fileInfos[0].FileSet, merged); err != nil {
+				t.Fatalf("Failed to format merged AST: %v", err)
+			}
+			generatedCode := buf.String()
+
+			if !strings.HasPrefix(generatedCode, tt.header+"\n") {
+				t.Errorf("Expected merged file to start with the header, got:\n%s", generatedCode)
+			}
+			if count := strings.Count(generatedCode, "DO NOT EDIT."); count != 1 {
+				t.Errorf("Expected the generated marker exactly once, found %d times:\n%s", count, generatedCode)
+			}
+			if tt.doc != "" && !strings.Contains(generatedCode, tt.doc) {
+				t.Errorf("Expected package doc %q above the package clause, got:\n%s", tt.doc, generatedCode)
+			}
+			if strings.Index(generatedCode, "DO NOT EDIT.") > strings.Index(generatedCode, "\npackage ") {
+				t.Errorf("Expected the header above the package clause, got:\n%s", generatedCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"entgo.io/ent/entc/gen"
+	"github.com/codelite7/entsquish"
+)
+
+// interruptedRun lays out a gen tree where the user package was squished
+// and the pet package was interrupted halfway through its merge.
+func interruptedRun(t *testing.T) string {
+	t.Helper()
+	baseDir := t.TempDir()
+	writeEntityPackage(t, baseDir, "user")
+	writeEntityPackage(t, baseDir, "pet")
+
+	journalDir := filepath.Join(baseDir, entsquish.JournalDir)
+	for index, name := range []string{"user", "pet"} {
+		for _, file := range []string{name + ".go", "where.go"} {
+			data, err := os.ReadFile(filepath.Join(baseDir, name, file))
+			if err != nil {
+				t.Fatalf("Failed to read %s: %v", file, err)
+			}
+			writeFile(t, filepath.Join(journalDir, string(rune('0'+index)), file), string(data))
+		}
+	}
+	writeFile(t, filepath.Join(journalDir, "journal.json"), `{
+  "version": 1,
+  "packages": [
+    {"path": "user", "output": "user/user.go", "files": ["user/user.go", "user/where.go"], "done": true},
+    {"path": "pet", "output": "pet/pet.go", "files": ["pet/pet.go", "pet/where.go"], "done": false}
+  ]
+}`)
+
+	writeGenerated(t, filepath.Join(baseDir, "user", "user.go"), "package user\n\nconst Label = \"user\"\n\nfunc ID() int { return 0 }\n")
+	if err := os.Remove(filepath.Join(baseDir, "user", "where.go")); err != nil {
+		t.Fatalf("Failed to remove where.go: %v", err)
+	}
+	writeFile(t, filepath.Join(baseDir, "user", entsquish.ManifestFileName), `{"version": 1, "outputs": [{"output": "user.go"}]}`)
+	writeGenerated(t, filepath.Join(baseDir, "pet", "pet.go"), "package pet\n\nconst Lab")
+
+	return baseDir
+}
+
+func TestRecoverRollback(t *testing.T) {
+	baseDir := interruptedRun(t)
+
+	config := entsquish.DefaultSquishingConfig()
+	config.BaseDir = baseDir
+	if err := entsquish.Recover(config, entsquish.RecoverRollback); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+
+	for _, name := range []string{"user", "pet"} {
+		if code := readMerged(t, filepath.Join(baseDir, name), name+".go"); code != generatedHeader+"package "+name+"\n\nconst Label = \""+name+"\"\n" {
+			t.Errorf("Expected %s.go to be restored, got:\n%s", name, code)
+		}
+		readMerged(t, filepath.Join(baseDir, name), "where.go")
+	}
+	if _, err := os.Stat(filepath.Join(baseDir, "user", entsquish.ManifestFileName)); !os.IsNotExist(err) {
+		t.Errorf("Expected the manifest of the restored package to be removed, got %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(baseDir, entsquish.JournalDir)); !os.IsNotExist(err) {
+		t.Errorf("Expected the journal to be removed, got %v", err)
+	}
+}
+
+func TestRecoverFinish(t *testing.T) {
+	baseDir := interruptedRun(t)
+
+	config := entsquish.DefaultSquishingConfig()
+	config.BaseDir = baseDir
+	if err := entsquish.Recover(config, entsquish.RecoverFinish); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+
+	for _, name := range []string{"user", "pet"} {
+		code := readMerged(t, filepath.Join(baseDir, name), name+".go")
+		if !strings.Contains(code, "const Label") || !strings.Contains(code, "func ID()") {
+			t.Errorf("Expected %s to be squished, got:\n%s", name, code)
+		}
+		if _, err := os.Stat(filepath.Join(baseDir, name, "where.go")); !os.IsNotExist(err) {
+			t.Errorf("Expected %s/where.go to be merged away, got %v", name, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(baseDir, entsquish.JournalDir)); !os.IsNotExist(err) {
+		t.Errorf("Expected the journal to be removed, got %v", err)
+	}
+}
+
+func TestSquishRefusesInterruptedRun(t *testing.T) {
+	baseDir := interruptedRun(t)
+
+	ext, err := entsquish.NewExtension(entsquish.WithBaseDir(baseDir))
+	if err != nil {
+		t.Fatalf("NewExtension failed: %v", err)
+	}
+
+	generate := ext.Hooks()[0](gen.GenerateFunc(func(*gen.Graph) error { return nil }))
+	err = generate.Generate(&gen.Graph{Config: &gen.Config{Target: baseDir}})
+	if !errors.Is(err, entsquish.ErrInterruptedRun) {
+		t.Fatalf("Expected ErrInterruptedRun, got %v", err)
+	}
+
+	// Recovering clears the way for the next run
+	if err := ext.Recover(entsquish.RecoverRollback); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	if err := generate.Generate(&gen.Graph{Config: &gen.Config{Target: baseDir}}); err != nil {
+		t.Fatalf("Generate failed after recovery: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(baseDir, entsquish.JournalDir)); !os.IsNotExist(err) {
+		t.Errorf("Expected a completed run to remove its journal, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(baseDir, "user", "where.go")); !os.IsNotExist(err) {
+		t.Errorf("Expected the user package to be squished, got %v", err)
+	}
+}
+
+func TestRecoverRemovesShards(t *testing.T) {
+	baseDir := t.TempDir()
+	originals := map[string]string{
+		"client.go": "package ent\n\nconst Client = \"client\"\n",
+		"ent.go":    "package ent\n\nconst Ent = \"ent\"\n",
+	}
+	for name, content := range originals {
+		writeFile(t, filepath.Join(baseDir, entsquish.JournalDir, "0", name), content)
+	}
+	writeFile(t, filepath.Join(baseDir, entsquish.JournalDir, "journal.json"), `{
+  "version": 1,
+  "packages": [
+    {"path": ".", "output": "gen.go", "sharded": true, "files": ["client.go", "ent.go"], "done": false}
+  ]
+}`)
+
+	// The run was interrupted after writing the shards
+	writeFile(t, filepath.Join(baseDir, "gen_1.go"), "package ent\n\nconst Client = \"client\"\n")
+	writeFile(t, filepath.Join(baseDir, "gen_2.go"), "package ent\n\nconst Ent = \"ent\"\n")
+	writeFile(t, filepath.Join(baseDir, "gen_extra.go"), "package ent\n")
+
+	config := entsquish.DefaultSquishingConfig()
+	config.BaseDir = baseDir
+	if err := entsquish.Recover(config, entsquish.RecoverRollback); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+
+	for name, content := range originals {
+		if code := readMerged(t, baseDir, name); code != content {
+			t.Errorf("Expected %s to be restored, got:\n%s", name, code)
+		}
+	}
+	for _, name := range []string{"gen_1.go", "gen_2.go"} {
+		if _, err := os.Stat(filepath.Join(baseDir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", name, err)
+		}
+	}
+	readMerged(t, baseDir, "gen_extra.go")
+}
@@ -0,0 +1,175 @@
+package test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codelite7/entsquish"
+)
+
+func TestManifestRecordsProvenance(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "user.go"), `package user
+
+import "entgo.io/ent/dialect/sql"
+
+// Table is the table name.
+const Table = "users"
+
+// Select selects from the users table.
+func Select() *sql.Selector {
+	return sql.Select(Table)
+}
+`)
+	writeFile(t, filepath.Join(dir, "where.go"), `package user
+
+import "database/sql"
+
+// Open opens the users database.
+func Open(name string) (*sql.DB, error) {
+	return sql.Open("sqlite3", name)
+}
+`)
+
+	config := entsquish.DefaultSquishingConfig()
+	config.ConflictPolicy = entsquish.ConflictRename
+	pkg := entsquish.SquishablePackage{
+		Path:          dir,
+		Files:         []string{"user.go", "where.go"},
+		EntityName:    "user",
+		HasEntityFile: true,
+		HasWhereFile:  true,
+	}
+	if _, err := entsquish.NewFileMergerFromConfig(config).MergePackage(pkg); err != nil {
+		t.Fatalf("MergePackage failed: %v", err)
+	}
+
+	manifest, err := entsquish.ReadManifest(dir)
+	if err != nil || manifest == nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	output := manifest.Output("user.go")
+	if output == nil {
+		t.Fatalf("Expected an entry for user.go, got %+v", manifest.Outputs)
+	}
+
+	sum := sha256.Sum256([]byte(readMerged(t, dir, "user.go")))
+	if output.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("Checksum %s does not match the merged file", output.SHA256)
+	}
+	if output.Entsquish == "" {
+		t.Error("Expected the entsquish version to be recorded")
+	}
+	if output.Options.ConflictPolicy != "rename" || output.Options.MaxFileSize != config.MaxFileSize {
+		t.Errorf("Unexpected options %+v", output.Options)
+	}
+	if output.Stats.FilesProcessed != 2 {
+		t.Errorf("Expected the stats to be recorded, got %+v", output.Stats)
+	}
+
+	want := []entsquish.DeclarationOrigin{
+		{Name: "const:Table", File: "user.go", StartLine: 5, EndLine: 6},
+		{Name: "func:Select", File: "user.go", StartLine: 8, EndLine: 11},
+		{Name: "func:Open", File: "where.go", StartLine: 5, EndLine: 8},
+	}
+	if len(output.Declarations) != len(want) {
+		t.Fatalf("Expected %d declarations, got %+v", len(want), output.Declarations)
+	}
+	for i, origin := range output.Declarations {
+		if origin.Name != want[i].Name || origin.File != want[i].File ||
+			origin.StartLine != want[i].StartLine || origin.EndLine != want[i].EndLine {
+			t.Errorf("Declaration %d: expected %+v, got %+v", i, want[i], origin)
+		}
+	}
+
+	if len(output.Aliases) != 2 {
+		t.Fatalf("Expected both sql packages to be aliased, got %+v", output.Aliases)
+	}
+	for _, alias := range output.Aliases {
+		if alias.Name == "sql" || len(alias.Files) != 1 {
+			t.Errorf("Unexpected alias %+v", alias)
+		}
+	}
+}
+
+func TestLineDirectivesPointAtOriginalFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "user.go"), `package user
+
+import "fmt"
+
+// Label is the entity label.
+const Label = "user"
+
+func Describe() string {
+	return fmt.Sprint(Label)
+}
+`)
+	writeFile(t, filepath.Join(dir, "where.go"), `package user
+
+import "strings"
+
+// Upper returns the label in upper case.
+//
+// It is used by the tests.
+func Upper() string {
+	s := Label
+	return strings.ToUpper(s)
+}
+`)
+
+	config := entsquish.DefaultSquishingConfig()
+	config.LineDirectives = true
+	pkg := entsquish.SquishablePackage{
+		Path:          dir,
+		Files:         []string{"user.go", "where.go"},
+		EntityName:    "user",
+		HasEntityFile: true,
+		HasWhereFile:  true,
+	}
+	if _, err := entsquish.NewFileMergerFromConfig(config).MergePackage(pkg); err != nil {
+		t.Fatalf("MergePackage failed: %v", err)
+	}
+
+	fileSet := token.NewFileSet()
+	file, err := parser.ParseFile(fileSet, filepath.Join(dir, "user.go"), nil, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("Failed to parse merged file: %v", err)
+	}
+
+	want := map[string]string{
+		"Label":    "user.go:6",
+		"Describe": "user.go:8",
+		"s":        "where.go:9",
+		"ToUpper":  "where.go:10",
+	}
+	ast.Inspect(file, func(n ast.Node) bool {
+		ident, ok := n.(*ast.Ident)
+		if !ok || want[ident.Name] == "" {
+			return true
+		}
+		position := fileSet.Position(ident.Pos())
+		if got := fmt.Sprintf("%s:%d", filepath.Base(position.Filename), position.Line); got != want[ident.Name] {
+			t.Errorf("Expected %s at %s, got %s", ident.Name, want[ident.Name], got)
+		}
+		delete(want, ident.Name)
+		return true
+	})
+	if len(want) > 0 {
+		t.Errorf("Identifiers not found in the merged file: %v", want)
+	}
+
+	if err := entsquish.Unsquish(dir); err != nil {
+		t.Fatalf("Unsquish failed: %v", err)
+	}
+	if code := readMerged(t, dir, "where.go"); strings.Contains(code, "//line") {
+		t.Errorf("Expected Unsquish to drop the directives, got:\n%s", code)
+	}
+}
@@ -0,0 +1,157 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codelite7/entsquish"
+)
+
+// writeEntityRoot lays out a root package with the files ent writes for the
+// user and pet entities along with the shared plumbing.
+func writeEntityRoot(t *testing.T, baseDir string) {
+	t.Helper()
+	files := map[string]string{
+		"client.go":         "package ent\n\ntype Client struct{}\n",
+		"tx.go":             "package ent\n\ntype Tx struct{}\n",
+		"user.go":           "package ent\n\ntype User struct{}\n",
+		"user_create.go":    "package ent\n\ntype UserCreate struct{}\n",
+		"user_query.go":     "package ent\n\ntype UserQuery struct{}\n",
+		"pet.go":            "package ent\n\ntype Pet struct{}\n",
+		"pet_create.go":     "package ent\n\ntype PetCreate struct{}\n",
+		"petowner.go":       "package ent\n\ntype PetOwner struct{}\n",
+		"petowner_query.go": "package ent\n\ntype PetOwnerQuery struct{}\n",
+	}
+	for name, content := range files {
+		writeGenerated(t, filepath.Join(baseDir, name), content)
+	}
+}
+
+// perEntityPolicy selects StrategyPerEntity for the root package.
+var perEntityPolicy = entsquish.Policy{
+	Packages: []entsquish.PackageRule{{Match: ".", Strategy: entsquish.StrategyPerEntity}},
+}
+
+func TestPerEntityGroupsRootFiles(t *testing.T) {
+	baseDir := t.TempDir()
+	writeEntityRoot(t, baseDir)
+	writeEntityPackage(t, baseDir, "user")
+	writeEntityPackage(t, baseDir, "pet")
+	writeEntityPackage(t, baseDir, "petowner")
+
+	config := entsquish.DefaultSquishingConfig()
+	config.BaseDir = baseDir
+	config.Policy = perEntityPolicy.WithDefaults()
+
+	packages, err := entsquish.NewPackageDetectorFromConfig(config).FindSquishablePackages()
+	if err != nil {
+		t.Fatalf("FindSquishablePackages failed: %v", err)
+	}
+
+	groups := make(map[string]string)
+	for _, pkg := range packages {
+		if pkg.Path == baseDir {
+			groups[pkg.OutputFile] = strings.Join(pkg.Files, ",")
+		}
+	}
+	expected := map[string]string{
+		"":            "client.go,tx.go",
+		"pet.go":      "pet.go,pet_create.go",
+		"petowner.go": "petowner.go,petowner_query.go",
+		"user.go":     "user.go,user_create.go,user_query.go",
+	}
+	if len(groups) != len(expected) {
+		t.Errorf("Expected %d root groups, got %v", len(expected), groups)
+	}
+	for output, files := range expected {
+		if groups[output] != files {
+			t.Errorf("Expected %q to merge %s, got %s", output, files, groups[output])
+		}
+	}
+}
+
+func TestPerEntitySquish(t *testing.T) {
+	baseDir := t.TempDir()
+	writeEntityRoot(t, baseDir)
+
+	// Without entity packages to infer them from, the entities are given
+	config := entsquish.DefaultSquishingConfig()
+	config.BaseDir = baseDir
+	config.Policy = perEntityPolicy.WithDefaults()
+	config.Entities = []string{"user", "pet"}
+
+	packages, err := entsquish.NewPackageDetectorFromConfig(config).FindSquishablePackages()
+	if err != nil {
+		t.Fatalf("FindSquishablePackages failed: %v", err)
+	}
+	merger := entsquish.NewFileMergerFromConfig(config)
+	for _, pkg := range packages {
+		if _, err := merger.MergePackage(pkg); err != nil {
+			t.Fatalf("MergePackage failed: %v", err)
+		}
+	}
+
+	entries, err := os.ReadDir(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if got := strings.Join(names, ","); got != entsquish.ManifestFileName+",gen.go,pet.go,user.go" {
+		t.Errorf("Expected the root to hold gen.go, pet.go and user.go, got %s", got)
+	}
+
+	if code := readMerged(t, baseDir, "gen.go"); !strings.Contains(code, "type PetOwnerQuery struct") || !strings.Contains(code, "type Tx struct") {
+		t.Errorf("Expected the files of unknown entities in gen.go, got:\n%s", code)
+	}
+	if code := readMerged(t, baseDir, "user.go"); !strings.Contains(code, "type UserCreate struct") || !strings.Contains(code, "type UserQuery struct") {
+		t.Errorf("Expected the user files in user.go, got:\n%s", code)
+	}
+}
+
+func TestPerEntitySquishTwice(t *testing.T) {
+	baseDir := t.TempDir()
+	writeEntityRoot(t, baseDir)
+	writeEntityPackage(t, baseDir, "user")
+	writeEntityPackage(t, baseDir, "pet")
+
+	config := entsquish.DefaultSquishingConfig()
+	config.BaseDir = baseDir
+	config.Policy = perEntityPolicy.WithDefaults()
+
+	snapshot := func() map[string]string {
+		entries, err := os.ReadDir(baseDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := make(map[string]string)
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files[entry.Name()] = readMerged(t, baseDir, entry.Name())
+			}
+		}
+		return files
+	}
+	squishTree(t, config)
+	first := snapshot()
+
+	// The entity packages no longer hold where.go the second time
+	squishTree(t, config)
+	second := snapshot()
+
+	if len(first) != len(second) {
+		t.Errorf("Expected the same files after the second run, got %d and %d", len(first), len(second))
+	}
+	for name, content := range first {
+		if second[name] != content {
+			t.Errorf("%s changed in the second run", name)
+		}
+	}
+	if _, ok := second["user.go"]; !ok {
+		t.Errorf("Expected user.go to stay apart from gen.go")
+	}
+}
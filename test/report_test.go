@@ -0,0 +1,97 @@
+package test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"entgo.io/ent/entc/gen"
+	"github.com/codelite7/entsquish"
+)
+
+func TestMergePackageResult(t *testing.T) {
+	baseDir := t.TempDir()
+	writeGenerated(t, filepath.Join(baseDir, "user", "user.go"), "package user\n\nimport \"fmt\"\n\nfunc Label() string { return fmt.Sprint(\"user\") }\n")
+	writeGenerated(t, filepath.Join(baseDir, "user", "where.go"), "package user\n\nimport \"fmt\"\n\nfunc ID() string { return fmt.Sprint(0) }\n\nfunc Name() string { return \"\" }\n")
+
+	config := entsquish.DefaultSquishingConfig()
+	config.BaseDir = baseDir
+	pkg := entsquish.SquishablePackage{
+		Path:          filepath.Join(baseDir, "user"),
+		Files:         []string{"user.go", "where.go"},
+		EntityName:    "user",
+		HasEntityFile: true,
+		HasWhereFile:  true,
+	}
+	result, err := entsquish.NewFileMergerFromConfig(config).MergePackage(pkg)
+	if err != nil {
+		t.Fatalf("MergePackage failed: %v", err)
+	}
+
+	if !result.Success || result.OutputPath != filepath.Join(pkg.Path, "user.go") || len(result.OriginalFiles) != 2 {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+
+	merged := readMerged(t, pkg.Path, "user.go")
+	stats := result.Stats
+	if stats.FilesProcessed != 2 || stats.ImportsDeduped != 1 || stats.DeclarationsAdded != 3 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if stats.MergedSize != int64(len(merged)) || stats.SizeReduction != stats.OriginalSize-stats.MergedSize {
+		t.Errorf("Unexpected sizes: %+v (merged file has %d bytes)", stats, len(merged))
+	}
+}
+
+func TestWithReportPath(t *testing.T) {
+	baseDir := t.TempDir()
+	writeEntityPackage(t, baseDir, "user")
+	writeGenerated(t, filepath.Join(baseDir, "pet", "pet.go"), "package pet\n\nfunc A() {}\n")
+	writeGenerated(t, filepath.Join(baseDir, "pet", "where.go"), "package pet\n\nfunc A() { println() }\n")
+	writeGenerated(t, filepath.Join(baseDir, "predicate", "predicate.go"), "package predicate\n")
+	reportPath := filepath.Join(t.TempDir(), "report.json")
+
+	ext, err := entsquish.NewExtension(entsquish.WithBaseDir(baseDir), entsquish.WithReportPath(reportPath))
+	if err != nil {
+		t.Fatalf("NewExtension failed: %v", err)
+	}
+	generate := ext.Hooks()[0](gen.GenerateFunc(func(*gen.Graph) error { return nil }))
+	if err := generate.Generate(&gen.Graph{Config: &gen.Config{Target: baseDir}}); err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+
+	data, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("Failed to read report: %v", err)
+	}
+	var report struct {
+		Results []struct {
+			Package string `json:"package"`
+			Success bool   `json:"success"`
+			Error   string `json:"error"`
+		} `json:"results"`
+		Skipped []entsquish.SkippedPackage `json:"skipped"`
+		Totals  entsquish.ReportTotals     `json:"totals"`
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("Failed to parse report: %v\n%s", err, data)
+	}
+
+	if report.Totals.Merged != 1 || report.Totals.Failed != 1 || report.Totals.FilesBefore != 2 || report.Totals.FilesAfter != 1 {
+		t.Errorf("Unexpected totals: %+v", report.Totals)
+	}
+	for _, result := range report.Results {
+		// The pet package declares A twice with different bodies
+		if filepath.Base(result.Package) == "pet" && (result.Success || result.Error == "") {
+			t.Errorf("Expected the pet package to fail with an error, got %+v", result)
+		}
+	}
+
+	skipped := map[string]string{}
+	for _, pkg := range report.Skipped {
+		skipped[filepath.Base(pkg.Path)] = pkg.Reason
+	}
+	if skipped["predicate"] != "excluded by policy" {
+		t.Errorf("Expected predicate to be skipped by policy, got %v", skipped)
+	}
+}
@@ -0,0 +1,220 @@
+package test
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codelite7/entsquish"
+)
+
+// writeShardableRoot lays out a root package with a type whose methods are
+// spread over two files and a number of standalone functions.
+func writeShardableRoot(t *testing.T, baseDir string) map[string]string {
+	t.Helper()
+	originals := map[string]string{
+		"client.go": `// Code generated by ent, DO NOT EDIT.
+
+// Package ent is the generated client.
+package ent
+
+import (
+	"fmt"
+)
+
+// Client is the client.
+type Client struct {
+	name string
+}
+
+// Describe describes the client.
+func (c *Client) Describe() string {
+	return fmt.Sprint(c.name)
+}
+`,
+		"tx.go": `// Code generated by ent, DO NOT EDIT.
+
+package ent
+
+import (
+	"strings"
+)
+
+// Close closes the client.
+func (c *Client) Close() string {
+	return strings.ToUpper(c.name)
+}
+`,
+	}
+
+	var funcs strings.Builder
+	funcs.WriteString("// Code generated by ent, DO NOT EDIT.\n\npackage ent\n\nimport (\n\t\"strconv\"\n)\n")
+	for i := range 12 {
+		fmt.Fprintf(&funcs, "\n// Label%02d returns a label.\nfunc Label%02d() string {\n\treturn strconv.Itoa(%d)\n}\n", i, i, i)
+	}
+	originals["labels.go"] = funcs.String()
+
+	for name, content := range originals {
+		writeFile(t, filepath.Join(baseDir, name), content)
+	}
+	return originals
+}
+
+func TestShardedRootPackage(t *testing.T) {
+	baseDir := t.TempDir()
+	originals := writeShardableRoot(t, baseDir)
+
+	ext, err := entsquish.NewExtension(entsquish.WithBaseDir(baseDir), entsquish.WithTargetFileSize(400))
+	if err != nil {
+		t.Fatalf("NewExtension failed: %v", err)
+	}
+	report, err := ext.Squish()
+	if err != nil {
+		t.Fatalf("Squish failed: %v", err)
+	}
+
+	if len(report.Results) != 1 {
+		t.Fatalf("Expected 1 result, got %d", len(report.Results))
+	}
+	result := report.Results[0]
+	if !result.Success || len(result.Shards) < 2 || result.OutputPath != result.Shards[0] {
+		t.Fatalf("Expected the root package to be sharded, got %+v", result)
+	}
+	if report.Totals.FilesAfter != len(result.Shards) {
+		t.Errorf("Expected %d files after, got %d", len(result.Shards), report.Totals.FilesAfter)
+	}
+	for name := range originals {
+		if _, err := os.Stat(filepath.Join(baseDir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", name, err)
+		}
+	}
+
+	fileSet := token.NewFileSet()
+	for i, shard := range result.Shards {
+		if want := filepath.Join(baseDir, fmt.Sprintf("gen_%d.go", i+1)); shard != want {
+			t.Errorf("Expected shard %d to be %s, got %s", i, want, shard)
+		}
+
+		code := readMerged(t, baseDir, filepath.Base(shard))
+		file, err := parser.ParseFile(fileSet, shard, code, parser.ParseComments)
+		if err != nil {
+			t.Fatalf("Shard %s does not parse: %v", shard, err)
+		}
+		if !strings.HasPrefix(code, "// Code generated by ent, DO NOT EDIT.") {
+			t.Errorf("Expected shard %s to keep the header", shard)
+		}
+		if hasDoc := file.Doc != nil; hasDoc != (i == 0) {
+			t.Errorf("Expected only the first shard to carry the package doc, %s has it: %v", shard, hasDoc)
+		}
+
+		// Every import is used, and the type stays with its methods
+		for _, imp := range file.Imports {
+			name := strings.Trim(imp.Path.Value, `"`)
+			if !strings.Contains(code, name+".") {
+				t.Errorf("Shard %s imports %s without using it", shard, name)
+			}
+		}
+		if strings.Contains(code, "type Client struct") != strings.Contains(code, "func (c *Client) Close()") {
+			t.Errorf("Expected Client and its methods in the same shard:\n%s", code)
+		}
+
+		info, err := os.Stat(shard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 400 && !strings.Contains(code, "type Client struct") {
+			t.Errorf("Shard %s is %d bytes, over the target", shard, info.Size())
+		}
+	}
+
+	// The shards go back to the original files
+	if err := ext.Unsquish(); err != nil {
+		t.Fatalf("Unsquish failed: %v", err)
+	}
+	for name, content := range originals {
+		if restored := readMerged(t, baseDir, name); restored != content {
+			t.Errorf("Expected %s to be restored as:\n%s\ngot:\n%s", name, content, restored)
+		}
+	}
+	for _, shard := range result.Shards {
+		if _, err := os.Stat(shard); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", shard, err)
+		}
+	}
+}
+
+func TestShardsAreDeterministic(t *testing.T) {
+	squish := func() map[string]string {
+		baseDir := t.TempDir()
+		writeShardableRoot(t, baseDir)
+
+		ext, err := entsquish.NewExtension(entsquish.WithBaseDir(baseDir), entsquish.WithTargetFileLines(30))
+		if err != nil {
+			t.Fatalf("NewExtension failed: %v", err)
+		}
+		report, err := ext.Squish()
+		if err != nil {
+			t.Fatalf("Squish failed: %v", err)
+		}
+
+		shards := make(map[string]string)
+		for _, shard := range report.Results[0].Shards {
+			code := readMerged(t, baseDir, filepath.Base(shard))
+			if lines := strings.Count(code, "\n"); lines > 30 {
+				t.Errorf("Shard %s has %d lines, over the target:\n%s", shard, lines, code)
+			}
+			shards[filepath.Base(shard)] = code
+		}
+		return shards
+	}
+
+	first, second := squish(), squish()
+	if len(first) < 2 || len(first) != len(second) {
+		t.Fatalf("Expected the same number of shards, got %d and %d", len(first), len(second))
+	}
+	for name, code := range first {
+		if second[name] != code {
+			t.Errorf("%s differs between runs", name)
+		}
+	}
+}
+
+func TestEntityNamedGenIsNotRoot(t *testing.T) {
+	baseDir := t.TempDir()
+	writeShardableRoot(t, baseDir)
+	writeEntityPackage(t, baseDir, "gen")
+
+	ext, err := entsquish.NewExtension(entsquish.WithBaseDir(baseDir), entsquish.WithTargetFileLines(30))
+	if err != nil {
+		t.Fatalf("NewExtension failed: %v", err)
+	}
+	report, err := ext.Squish()
+	if err != nil {
+		t.Fatalf("Squish failed: %v", err)
+	}
+
+	for _, result := range report.Results {
+		if filepath.Dir(result.OutputPath) != filepath.Join(baseDir, "gen") {
+			continue
+		}
+		if result.OutputPath != filepath.Join(baseDir, "gen", "gen.go") || len(result.Shards) != 0 {
+			t.Errorf("Expected the gen entity package merged into gen/gen.go, got %s and shards %v", result.OutputPath, result.Shards)
+		}
+	}
+	if code := readMerged(t, baseDir, "gen/gen.go"); !strings.Contains(code, "func ID()") {
+		t.Errorf("Expected where.go in gen/gen.go, got:\n%s", code)
+	}
+}
+
+func TestWithTargetFileSizeRejectsZero(t *testing.T) {
+	if _, err := entsquish.NewExtension(entsquish.WithTargetFileSize(0)); err == nil {
+		t.Error("Expected WithTargetFileSize(0) to fail")
+	}
+	if _, err := entsquish.NewExtension(entsquish.WithTargetFileLines(0)); err == nil {
+		t.Error("Expected WithTargetFileLines(0) to fail")
+	}
+}
@@ -0,0 +1,99 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codelite7/entsquish"
+)
+
+// writeTestFiles adds internal and external test files to the root package
+// and the user package.
+func writeTestFiles(t *testing.T, baseDir string) {
+	t.Helper()
+	writeGenerated(t, filepath.Join(baseDir, "client.go"), "package ent\n\ntype Client struct{}\n")
+	writeGenerated(t, filepath.Join(baseDir, "tx.go"), "package ent\n\ntype Tx struct{}\n")
+	writeGenerated(t, filepath.Join(baseDir, "client_test.go"), "package ent\n\nfunc newClient() *Client { return &Client{} }\n")
+	writeGenerated(t, filepath.Join(baseDir, "tx_test.go"), "package ent\n\nfunc newTx() *Tx { return &Tx{} }\n")
+	writeGenerated(t, filepath.Join(baseDir, "example_test.go"), "package ent_test\n\nfunc Example() {}\n")
+	writeGenerated(t, filepath.Join(baseDir, "example_tx_test.go"), "package ent_test\n\nfunc Example_tx() {}\n")
+	writeEntityPackage(t, baseDir, "user")
+	writeGenerated(t, filepath.Join(baseDir, "user", "user_test.go"), "package user\n\nconst testLabel = Label\n")
+	writeGenerated(t, filepath.Join(baseDir, "user", "where_test.go"), "package user\n\nvar testID = ID()\n")
+}
+
+// squishTree detects and merges every package of config.BaseDir.
+func squishTree(t *testing.T, config entsquish.SquishingConfig) []entsquish.SquishablePackage {
+	t.Helper()
+	packages, err := entsquish.NewPackageDetectorFromConfig(config).FindSquishablePackages()
+	if err != nil {
+		t.Fatalf("FindSquishablePackages failed: %v", err)
+	}
+	merger := entsquish.NewFileMergerFromConfig(config)
+	for _, pkg := range packages {
+		if _, err := merger.MergePackage(pkg); err != nil {
+			t.Fatalf("MergePackage of %s failed: %v", pkg.Path, err)
+		}
+	}
+	return packages
+}
+
+func TestTestFilesAreLeftAlone(t *testing.T) {
+	baseDir := t.TempDir()
+	writeTestFiles(t, baseDir)
+
+	config := entsquish.DefaultSquishingConfig()
+	config.BaseDir = baseDir
+	for _, pkg := range squishTree(t, config) {
+		for _, file := range pkg.Files {
+			if strings.HasSuffix(file, "_test.go") {
+				t.Errorf("Expected %s not to be merged", filepath.Join(pkg.Path, file))
+			}
+		}
+	}
+
+	if code := readMerged(t, baseDir, "gen.go"); strings.Contains(code, "newClient") {
+		t.Errorf("Expected no test code in gen.go, got:\n%s", code)
+	}
+	for _, name := range []string{"client_test.go", "tx_test.go", "example_test.go", "example_tx_test.go", "user/user_test.go", "user/where_test.go"} {
+		readMerged(t, baseDir, name)
+	}
+}
+
+func TestMergeTests(t *testing.T) {
+	baseDir := t.TempDir()
+	writeTestFiles(t, baseDir)
+
+	config := entsquish.DefaultSquishingConfig()
+	config.BaseDir = baseDir
+	config.MergeTests = true
+	config.Verify = true
+	squishTree(t, config)
+
+	expected := map[string]string{
+		"gen.go":               "package ent\n",
+		"gen_test.go":          "package ent\n",
+		"gen_external_test.go": "package ent_test\n",
+		"user/user.go":         "package user\n",
+		"user/user_test.go":    "package user\n",
+	}
+	for name, clause := range expected {
+		if code := readMerged(t, baseDir, name); !strings.Contains(code, clause) {
+			t.Errorf("Expected %s to hold %q, got:\n%s", name, strings.TrimSpace(clause), code)
+		}
+	}
+	if code := readMerged(t, baseDir, "gen_external_test.go"); !strings.Contains(code, "func Example_tx()") {
+		t.Errorf("Expected example_tx_test.go in gen_external_test.go, got:\n%s", code)
+	}
+	if code := readMerged(t, baseDir, "user/user_test.go"); !strings.Contains(code, "var testID = ID()") {
+		t.Errorf("Expected where_test.go in user_test.go, got:\n%s", code)
+	}
+
+	for _, name := range []string{"client_test.go", "tx_test.go", "example_test.go", "example_tx_test.go", "user/where_test.go"} {
+		if _, err := os.Stat(filepath.Join(baseDir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be merged away, got %v", name, err)
+		}
+	}
+}
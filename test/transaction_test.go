@@ -0,0 +1,89 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codelite7/entsquish"
+)
+
+func TestMergePackageReplacesFilesAtomically(t *testing.T) {
+	baseDir := t.TempDir()
+	writeEntityPackage(t, baseDir, "user")
+
+	pkgDir := filepath.Join(baseDir, "user")
+	if err := os.Chmod(filepath.Join(pkgDir, "user.go"), 0600); err != nil {
+		t.Fatalf("Failed to change mode: %v", err)
+	}
+
+	config := entsquish.DefaultSquishingConfig()
+	config.BaseDir = baseDir
+	pkg := entsquish.SquishablePackage{
+		Path:          pkgDir,
+		Files:         []string{"user.go", "where.go"},
+		EntityName:    "user",
+		HasEntityFile: true,
+		HasWhereFile:  true,
+	}
+	if _, err := entsquish.NewFileMergerFromConfig(config).MergePackage(pkg); err != nil {
+		t.Fatalf("MergePackage failed: %v", err)
+	}
+
+	entries, err := os.ReadDir(pkgDir)
+	if err != nil {
+		t.Fatalf("Failed to read package directory: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, ",") != entsquish.ManifestFileName+",user.go" {
+		t.Fatalf("Expected only user.go and the manifest to remain, got %v", names)
+	}
+
+	stat, err := os.Stat(filepath.Join(pkgDir, "user.go"))
+	if err != nil {
+		t.Fatalf("Failed to stat merged file: %v", err)
+	}
+	if stat.Mode().Perm() != 0600 {
+		t.Errorf("Expected the merged file to keep mode 0600, got %v", stat.Mode().Perm())
+	}
+
+	code := readMerged(t, pkgDir, "user.go")
+	if !strings.Contains(code, "const Label") || !strings.Contains(code, "func ID()") {
+		t.Errorf("Expected merged file to contain both files:\n%s", code)
+	}
+}
+
+func TestMergePackageRefusesForeignOutput(t *testing.T) {
+	baseDir := t.TempDir()
+	writeEntityPackage(t, baseDir, "user")
+
+	pkgDir := filepath.Join(baseDir, "user")
+	const foreign = "package user\n\n// Hand written.\n"
+	writeFile(t, filepath.Join(pkgDir, "merged.go"), foreign)
+
+	config := entsquish.DefaultSquishingConfig()
+	config.BaseDir = baseDir
+	pkg := entsquish.SquishablePackage{
+		Path:       pkgDir,
+		Files:      []string{"user.go", "where.go"},
+		EntityName: "user",
+		Strategy:   entsquish.StrategyMerge,
+		OutputFile: "merged.go",
+	}
+	if _, err := entsquish.NewFileMergerFromConfig(config).MergePackage(pkg); err == nil {
+		t.Fatal("Expected MergePackage to refuse overwriting merged.go")
+	}
+
+	if code := readMerged(t, pkgDir, "merged.go"); code != foreign {
+		t.Errorf("Expected merged.go to be unchanged, got:\n%s", code)
+	}
+	for _, name := range []string{"user.go", "where.go"} {
+		if _, err := os.Stat(filepath.Join(pkgDir, name)); err != nil {
+			t.Errorf("Expected %s to be left in place: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codelite7/entsquish"
+)
+
+func TestUnsquishRestoresOriginalFiles(t *testing.T) {
+	originals := map[string]string{
+		"user.go": `// Code generated by ent, DO NOT EDIT.
+
+package user
+
+import (
+	"fmt"
+
+	"entgo.io/ent/dialect/sql"
+)
+
+// Table is the table name.
+const Table = "users"
+
+// Select selects from the users table.
+func Select() *sql.Selector {
+	fmt.Println(Table)
+	return sql.Select(Table)
+}
+`,
+		"where.go": `// Code generated by ent, DO NOT EDIT.
+
+package user
+
+import (
+	"database/sql"
+)
+
+// Table is the table name.
+const Table = "users"
+
+// Open opens the users database.
+func Open(name string) (*sql.DB, error) {
+	return sql.Open("sqlite3", name)
+}
+`,
+	}
+
+	dir := t.TempDir()
+	for name, content := range originals {
+		writeFile(t, filepath.Join(dir, name), content)
+	}
+
+	pkg := entsquish.SquishablePackage{
+		Path:          dir,
+		Files:         []string{"user.go", "where.go"},
+		EntityName:    "user",
+		HasEntityFile: true,
+		HasWhereFile:  true,
+	}
+	fm := entsquish.NewFileMergerFromConfig(entsquish.DefaultSquishingConfig())
+	if _, err := fm.MergePackage(pkg); err != nil {
+		t.Fatalf("MergePackage failed: %v", err)
+	}
+	if merged := readMerged(t, dir, "user.go"); !strings.Contains(merged, "stdsql.DB") {
+		t.Fatalf("Expected the merge to alias database/sql, got:\n%s", merged)
+	}
+
+	if err := entsquish.Unsquish(dir); err != nil {
+		t.Fatalf("Unsquish failed: %v", err)
+	}
+
+	for name, content := range originals {
+		if restored := readMerged(t, dir, name); restored != content {
+			t.Errorf("Restored %s differs from the original:\n%s", name, restored)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, entsquish.ManifestFileName)); !os.IsNotExist(err) {
+		t.Errorf("Expected the manifest to be removed, got %v", err)
+	}
+}
+
+func TestUnsquishRefusesModifiedFile(t *testing.T) {
+	dir := t.TempDir()
+	writeEntityPackage(t, dir, "user")
+
+	pkg := entsquish.SquishablePackage{
+		Path:          filepath.Join(dir, "user"),
+		Files:         []string{"user.go", "where.go"},
+		EntityName:    "user",
+		HasEntityFile: true,
+		HasWhereFile:  true,
+	}
+	fm := entsquish.NewFileMergerFromConfig(entsquish.DefaultSquishingConfig())
+	if _, err := fm.MergePackage(pkg); err != nil {
+		t.Fatalf("MergePackage failed: %v", err)
+	}
+
+	merged := readMerged(t, pkg.Path, "user.go")
+	writeFile(t, filepath.Join(pkg.Path, "user.go"), merged+"\nfunc Extra() {}\n")
+
+	err := entsquish.Unsquish(pkg.Path)
+	if err == nil || !strings.Contains(err.Error(), "modified after squishing") {
+		t.Fatalf("Expected Unsquish to refuse a modified file, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(pkg.Path, "where.go")); !os.IsNotExist(err) {
+		t.Errorf("Expected where.go to stay merged, got %v", err)
+	}
+
+	if err := entsquish.Unsquish(t.TempDir()); err == nil {
+		t.Error("Expected Unsquish to fail without a manifest")
+	}
+}
+
+func TestUnsquishAfterSquishingTwice(t *testing.T) {
+	baseDir := t.TempDir()
+	writeEntityRoot(t, baseDir)
+	writeEntityPackage(t, baseDir, "user")
+	writeEntityPackage(t, baseDir, "pet")
+
+	// The second squish folds the per-entity files of the first into gen.go
+	squish := func(options ...entsquish.ExtensionOption) {
+		ext, err := entsquish.NewExtension(append([]entsquish.ExtensionOption{entsquish.WithBaseDir(baseDir)}, options...)...)
+		if err != nil {
+			t.Fatalf("NewExtension failed: %v", err)
+		}
+		if _, err := ext.Squish(); err != nil {
+			t.Fatalf("Squish failed: %v", err)
+		}
+	}
+	squish(entsquish.WithPolicy(perEntityPolicy))
+	squish()
+
+	manifest, err := entsquish.ReadManifest(baseDir)
+	if err != nil {
+		t.Fatalf("ReadManifest failed: %v", err)
+	}
+	if len(manifest.Outputs) != 1 || manifest.Outputs[0].Output != "gen.go" {
+		t.Errorf("Expected the manifest to list gen.go only, got %+v", manifest.Outputs)
+	}
+
+	ext, err := entsquish.NewExtension(entsquish.WithBaseDir(baseDir))
+	if err != nil {
+		t.Fatalf("NewExtension failed: %v", err)
+	}
+	if err := ext.Unsquish(); err != nil {
+		t.Fatalf("Unsquish failed: %v", err)
+	}
+	for _, name := range []string{"gen.go", "user.go", "pet.go", "user/where.go", "pet/where.go"} {
+		if _, err := os.Stat(filepath.Join(baseDir, name)); err != nil {
+			t.Errorf("Expected %s to be restored: %v", name, err)
+		}
+	}
+}
+
+func TestUnsquishSkipsMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	writeEntityPackage(t, dir, "user")
+	writeEntityPackage(t, dir, "pet")
+
+	ext, err := entsquish.NewExtension(entsquish.WithBaseDir(dir))
+	if err != nil {
+		t.Fatalf("NewExtension failed: %v", err)
+	}
+	if _, err := ext.Squish(); err != nil {
+		t.Fatalf("Squish failed: %v", err)
+	}
+	if err := os.Remove(filepath.Join(dir, "user", "user.go")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+
+	err = ext.Unsquish()
+	if err == nil || !strings.Contains(err.Error(), "user.go") {
+		t.Errorf("Expected Unsquish to report the missing user.go, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pet", "where.go")); err != nil {
+		t.Errorf("Expected pet to be restored anyway: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "user", entsquish.ManifestFileName)); !os.IsNotExist(err) {
+		t.Errorf("Expected the entry of the missing file to be dropped, got %v", err)
+	}
+}
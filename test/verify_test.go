@@ -0,0 +1,89 @@
+package test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codelite7/entsquish"
+)
+
+func TestVerifyRevertsBrokenMerge(t *testing.T) {
+	const entityFile = `package user
+
+func Validate(name string) error { return nil }
+`
+	const whereFile = `package user
+
+import "errors"
+
+func Validate(name, other string) error { return errors.New(name + other) }
+
+func Check() error { return Validate("a", "b") }
+`
+
+	baseDir := t.TempDir()
+	writeFile(t, filepath.Join(baseDir, "user", "user.go"), entityFile)
+	writeFile(t, filepath.Join(baseDir, "user", "where.go"), whereFile)
+
+	config := entsquish.DefaultSquishingConfig()
+	config.BaseDir = baseDir
+	config.ConflictPolicy = entsquish.ConflictKeepFirst
+	config.Verify = true
+	config.CacheDir = t.TempDir()
+
+	pkg := entsquish.SquishablePackage{
+		Path:          filepath.Join(baseDir, "user"),
+		Files:         []string{"user.go", "where.go"},
+		EntityName:    "user",
+		HasEntityFile: true,
+		HasWhereFile:  true,
+	}
+	_, err := entsquish.NewFileMergerFromConfig(config).MergePackage(pkg)
+
+	// Dropping the second Validate leaves its import unused
+	var verifyErr *entsquish.VerifyError
+	if !errors.As(err, &verifyErr) {
+		t.Fatalf("Expected a *VerifyError, got %v", err)
+	}
+	if len(verifyErr.Diagnostics) != 1 || !strings.Contains(verifyErr.Diagnostics[0], `"errors" imported and not used`) {
+		t.Errorf("Unexpected diagnostics: %q", verifyErr.Diagnostics)
+	}
+
+	if code := readMerged(t, pkg.Path, "user.go"); code != entityFile {
+		t.Errorf("Expected user.go to be reverted, got:\n%s", code)
+	}
+	if code := readMerged(t, pkg.Path, "where.go"); code != whereFile {
+		t.Errorf("Expected where.go to be restored, got:\n%s", code)
+	}
+
+	// A reverted merge is not cached
+	if entries, err := os.ReadDir(config.CacheDir); err != nil || len(entries) != 0 {
+		t.Errorf("Expected an empty cache, got %d entries (%v)", len(entries), err)
+	}
+}
+
+func TestVerifyAcceptsCleanMerge(t *testing.T) {
+	baseDir := t.TempDir()
+	writeEntityPackage(t, baseDir, "user")
+
+	config := entsquish.DefaultSquishingConfig()
+	config.BaseDir = baseDir
+	config.Verify = true
+
+	pkg := entsquish.SquishablePackage{
+		Path:          filepath.Join(baseDir, "user"),
+		Files:         []string{"user.go", "where.go"},
+		EntityName:    "user",
+		HasEntityFile: true,
+		HasWhereFile:  true,
+	}
+	if _, err := entsquish.NewFileMergerFromConfig(config).MergePackage(pkg); err != nil {
+		t.Fatalf("MergePackage failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(pkg.Path, "where.go")); !os.IsNotExist(err) {
+		t.Errorf("Expected where.go to be merged away, got %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package entsquish
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// packageTransaction replaces the original files of a package with new
+// files, usually a single merged file, so that the package ends up either
+// fully rewritten or untouched.
+type packageTransaction struct {
+	// outputPaths are the paths of the files to write
+	outputPaths []string
+
+	// originals holds the content of every original file, keyed by path
+	originals map[string]originalFile
+
+	// order lists the original paths in the order they were given
+	order []string
+}
+
+// originalFile is a snapshot of a file taken before the merge.
+type originalFile struct {
+	data []byte
+	mode os.FileMode
+}
+
+// newPackageTransaction snapshots the original files of pkg. It refuses to
+// overwrite an existing output file that is not one of the originals.
+func newPackageTransaction(pkg SquishablePackage, outputPaths ...string) (*packageTransaction, error) {
+	tx := &packageTransaction{
+		outputPaths: outputPaths,
+		originals:   make(map[string]originalFile),
+	}
+
+	for _, fileName := range pkg.Files {
+		filePath := filepath.Join(pkg.Path, fileName)
+
+		stat, err := os.Stat(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat file %s: %w", filePath, err)
+		}
+
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file %s: %w", filePath, err)
+		}
+
+		tx.originals[filePath] = originalFile{data: data, mode: stat.Mode().Perm()}
+		tx.order = append(tx.order, filePath)
+	}
+
+	for _, outputPath := range outputPaths {
+		if _, isOriginal := tx.originals[outputPath]; !isOriginal {
+			if _, err := os.Lstat(outputPath); err == nil {
+				return nil, fmt.Errorf("output file %s already exists and is not part of the package", outputPath)
+			}
+		}
+	}
+
+	return tx, nil
+}
+
+// Commit writes contents[i] to the i-th output file through a synced
+// temporary file and an atomic rename, unless the file already holds it,
+// then removes the other originals. On failure every original is restored
+// and the output files are removed unless they were originals themselves.
+func (tx *packageTransaction) Commit(contents ...[]byte) (err error) {
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = fmt.Errorf("%w (rollback failed: %v)", err, rollbackErr)
+			}
+		}
+	}()
+
+	if len(contents) != len(tx.outputPaths) {
+		return fmt.Errorf("got %d contents for %d output files", len(contents), len(tx.outputPaths))
+	}
+
+	outputs := make(map[string]bool)
+	for i, outputPath := range tx.outputPaths {
+		outputs[outputPath] = true
+
+		mode := os.FileMode(0644)
+		if original, ok := tx.originals[outputPath]; ok {
+			// Leave a file that already holds the content alone, keeping
+			// its modification time
+			if bytes.Equal(original.data, contents[i]) {
+				continue
+			}
+			mode = original.mode
+		}
+
+		if err := writeFileAtomic(outputPath, contents[i], mode); err != nil {
+			return err
+		}
+	}
+
+	// Remove original files (except if they're the same as output)
+	for _, filePath := range tx.order {
+		if outputs[filePath] {
+			continue
+		}
+		if err := os.Remove(filePath); err != nil {
+			return fmt.Errorf("failed to remove file %s: %w", filePath, err)
+		}
+	}
+
+	return syncDir(filepath.Dir(tx.outputPaths[0]))
+}
+
+// Rollback restores every original file and removes the output files that
+// did not exist before.
+func (tx *packageTransaction) Rollback() error {
+	var errs []error
+
+	for _, outputPath := range tx.outputPaths {
+		if _, isOriginal := tx.originals[outputPath]; !isOriginal {
+			if err := os.Remove(outputPath); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, fmt.Errorf("failed to remove %s: %w", outputPath, err))
+			}
+		}
+	}
+
+	for _, filePath := range tx.order {
+		original := tx.originals[filePath]
+
+		// Skip files that are still intact
+		if current, err := os.ReadFile(filePath); err == nil && bytes.Equal(current, original.data) {
+			continue
+		}
+
+		if err := writeFileAtomic(filePath, original.data, original.mode); err != nil {
+			errs = append(errs, fmt.Errorf("failed to restore %s: %w", filePath, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// writeFileAtomic writes data to a temporary file in the target directory,
+// syncs it and renames it over path, so path never holds partial content.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".entsquish-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %s: %w", path, err)
+	}
+	tmpPath := tmp.Name()
+
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmpPath)
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		return fmt.Errorf("failed to write temporary file for %s: %w", path, err)
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		return fmt.Errorf("failed to set mode of temporary file for %s: %w", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to sync temporary file for %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file for %s: %w", path, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename temporary file to %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// syncDir flushes directory entries (renames and removals) to disk. Some
+// platforms cannot sync directories; that is not treated as an error.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %s: %w", dir, err)
+	}
+	defer d.Close()
+
+	_ = d.Sync()
+	return nil
+}
@@ -0,0 +1,188 @@
+package entsquish
+
+import (
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/modfile"
+)
+
+// treeLocks keeps verification from type-checking packages that are
+// half-written, while packages that do not import each other are merged and
+// checked at the same time. A write locks its directory. A check locks the
+// directory it type-checks and the module directories it imports, directly
+// or not, for reading. A check whose imports cannot be resolved, e.g.
+// outside of a module, locks the whole tree.
+type treeLocks struct {
+	tree sync.RWMutex
+
+	mu   sync.Mutex
+	dirs map[string]*sync.RWMutex
+
+	// The module of baseDir, looked up on the first check
+	baseDir    string
+	moduleOnce sync.Once
+	moduleRoot string
+	modulePath string
+	moduleErr  error
+}
+
+// newTreeLocks creates the locks of the gen tree in baseDir.
+func newTreeLocks(baseDir string) *treeLocks {
+	return &treeLocks{baseDir: baseDir, dirs: make(map[string]*sync.RWMutex)}
+}
+
+// dir returns the lock of a directory.
+func (l *treeLocks) dir(dir string) *sync.RWMutex {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock, ok := l.dirs[dir]
+	if !ok {
+		lock = &sync.RWMutex{}
+		l.dirs[dir] = lock
+	}
+	return lock
+}
+
+// lockWrite locks dir for writing, and returns the function unlocking it.
+func (l *treeLocks) lockWrite(dir string) func() {
+	l.tree.RLock()
+	lock := l.dir(filepath.Clean(dir))
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.tree.RUnlock()
+	}
+}
+
+// lockCheck locks dir and the module directories it imports for reading,
+// and returns the function unlocking them.
+func (l *treeLocks) lockCheck(dir string) func() {
+	dir = filepath.Clean(dir)
+	for {
+		dirs, err := l.importedDirs(dir)
+		if err != nil {
+			l.tree.Lock()
+			return l.tree.Unlock
+		}
+
+		// Directories are locked in order, so that checks never wait on
+		// each other in a cycle
+		l.tree.RLock()
+		locks := make([]*sync.RWMutex, len(dirs))
+		for i, imported := range dirs {
+			locks[i] = l.dir(imported)
+			locks[i].RLock()
+		}
+		unlock := func() {
+			for _, lock := range locks {
+				lock.RUnlock()
+			}
+			l.tree.RUnlock()
+		}
+
+		// The imports were read before the directories were locked, and
+		// may have changed since
+		locked, err := l.importedDirs(dir)
+		if err == nil && !slices.ContainsFunc(locked, func(imported string) bool {
+			_, found := slices.BinarySearch(dirs, imported)
+			return !found
+		}) {
+			return unlock
+		}
+		unlock()
+	}
+}
+
+// importedDirs returns dir and the directories of the packages of its
+// module it imports, directly or not, in sorted order. Imports are read from
+// all Go files, whatever their build constraints.
+func (l *treeLocks) importedDirs(dir string) ([]string, error) {
+	l.moduleOnce.Do(func() {
+		root, ok := findModuleRoot(l.baseDir)
+		if !ok {
+			l.moduleErr = errors.New("no go.mod found")
+			return
+		}
+		data, err := os.ReadFile(filepath.Join(root, "go.mod"))
+		if err != nil {
+			l.moduleErr = err
+			return
+		}
+		l.moduleRoot, l.modulePath = root, modfile.ModulePath(data)
+		if l.modulePath == "" {
+			l.moduleErr = fmt.Errorf("no module path in %s", filepath.Join(root, "go.mod"))
+		}
+	})
+	if l.moduleErr != nil {
+		return nil, l.moduleErr
+	}
+
+	seen := map[string]bool{dir: true}
+	queue := []string{dir}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		paths, err := dirImports(current)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			rel, ok := strings.CutPrefix(path, l.modulePath)
+			if !ok || (rel != "" && !strings.HasPrefix(rel, "/")) {
+				continue
+			}
+			imported := filepath.Join(l.moduleRoot, filepath.FromSlash(rel))
+			if !seen[imported] {
+				seen[imported] = true
+				queue = append(queue, imported)
+			}
+		}
+	}
+
+	dirs := make([]string, 0, len(seen))
+	for imported := range seen {
+		dirs = append(dirs, imported)
+	}
+	slices.Sort(dirs)
+	return dirs, nil
+}
+
+// dirImports returns the import paths of the Go files in dir. A missing
+// directory imports nothing.
+func dirImports(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	fileSet := token.NewFileSet()
+	var paths []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".go") {
+			continue
+		}
+		file, err := parser.ParseFile(fileSet, filepath.Join(dir, entry.Name()), nil, parser.ImportsOnly)
+		if err != nil {
+			return nil, err
+		}
+		for _, spec := range file.Imports {
+			if path, err := strconv.Unquote(spec.Path.Value); err == nil {
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths, nil
+}
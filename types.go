@@ -1,8 +1,10 @@
 package entsquish
 
 import (
+	"encoding/json"
 	"go/ast"
 	"go/token"
+	"io"
 )
 
 // SquishablePackage represents a package that can be safely squished.
@@ -21,6 +23,20 @@ type SquishablePackage struct {
 
 	// HasWhereFile indicates if there's a where.go file
 	HasWhereFile bool
+
+	// Strategy is the merge strategy selected by the policy
+	Strategy MergeStrategy
+
+	// OutputFile overrides the merged file name when set
+	OutputFile string
+
+	// BuildConstraint is the normalized //go:build expression shared by
+	// all Files, or empty for unconstrained files
+	BuildConstraint string
+
+	// Tests is set if Files are _test.go files of a single test package,
+	// which are merged into a _test.go file of their own
+	Tests bool
 }
 
 // FileInfo represents information about a Go file to be merged.
@@ -43,38 +59,76 @@ type FileInfo struct {
 
 // MergeResult represents the result of merging files.
 type MergeResult struct {
+	// Package is the package directory
+	Package string `json:"package"`
+
 	// Success indicates if the merge was successful
-	Success bool
+	Success bool `json:"success"`
 
 	// OutputPath is the path to the merged file
-	OutputPath string
+	OutputPath string `json:"output_path"`
 
 	// OriginalFiles are the original files that were merged
-	OriginalFiles []string
+	OriginalFiles []string `json:"original_files"`
 
-	// Error is any error that occurred during merging
-	Error error
+	// Error is any error that occurred during merging. It is encoded as
+	// its message in JSON.
+	Error error `json:"-"`
 
 	// Stats contains statistics about the merge
-	Stats MergeStats
+	Stats MergeStats `json:"stats"`
+
+	// Cached is set if the merged file came from the cache
+	Cached bool `json:"cached,omitempty"`
+
+	// Shards lists the files a sharded package was split into, OutputPath
+	// being the first
+	Shards []string `json:"shards,omitempty"`
+}
+
+// Outputs returns the files the package was merged into.
+func (r *MergeResult) Outputs() []string {
+	if len(r.Shards) > 0 {
+		return r.Shards
+	}
+	return []string{r.OutputPath}
+}
+
+// MarshalJSON encodes the result, including the message of Error.
+func (r MergeResult) MarshalJSON() ([]byte, error) {
+	type plain MergeResult
+	encoded := struct {
+		plain
+		Error string `json:"error,omitempty"`
+	}{plain: plain(r)}
+	if r.Error != nil {
+		encoded.Error = r.Error.Error()
+	}
+	return json.Marshal(encoded)
 }
 
 // MergeStats contains statistics about a merge operation.
 type MergeStats struct {
 	// FilesProcessed is the number of files processed
-	FilesProcessed int
+	FilesProcessed int `json:"files_processed"`
 
 	// LinesTotal is the total number of lines in merged file
-	LinesTotal int
+	LinesTotal int `json:"lines_total"`
 
 	// ImportsDeduped is the number of duplicate imports removed
-	ImportsDeduped int
+	ImportsDeduped int `json:"imports_deduped"`
 
 	// DeclarationsAdded is the number of declarations added
-	DeclarationsAdded int
+	DeclarationsAdded int `json:"declarations_added"`
+
+	// OriginalSize is the combined size of the original files (in bytes)
+	OriginalSize int64 `json:"original_size"`
+
+	// MergedSize is the size of the merged file (in bytes)
+	MergedSize int64 `json:"merged_size"`
 
 	// SizeReduction is the size reduction achieved (in bytes)
-	SizeReduction int64
+	SizeReduction int64 `json:"size_reduction"`
 }
 
 // PackageType represents the type of package for squishing decisions.
@@ -84,7 +138,8 @@ const (
 	// PackageTypeEntity represents a regular entity package (contact/, property/, etc.)
 	PackageTypeEntity PackageType = iota
 
-	// PackageTypeSpecial represents special packages that should not be squished
+	// PackageTypeSpecial represents nested packages that are only squished
+	// when the policy asks for it
 	PackageTypeSpecial
 
 	// PackageTypeRoot represents files in the root gen directory
@@ -110,7 +165,8 @@ func (pt PackageType) String() string {
 
 // SquishingConfig represents configuration for the squishing process.
 type SquishingConfig struct {
-	// BaseDir is the base directory for Ent generated files
+	// BaseDir is the base directory for Ent generated files. The Extension
+	// resolves it to an absolute path from gen.Config.Target.
 	BaseDir string
 
 	// DryRun indicates if this is a dry run (no actual changes)
@@ -121,14 +177,72 @@ type SquishingConfig struct {
 
 	// MaxFileSize is the maximum file size to process (safety limit)
 	MaxFileSize int64
+
+	// Policy decides which packages are squished and how. It is used as is,
+	// see Policy.WithDefaults.
+	Policy Policy
+
+	// ConflictPolicy decides how diverging duplicate declarations are handled
+	ConflictPolicy ConflictPolicy
+
+	// Verify type-checks every merged package and reverts those that gained
+	// type errors
+	Verify bool
+
+	// LineDirectives emits a //line directive above every merged
+	// declaration, pointing at its original file and line
+	LineDirectives bool
+
+	// Concurrency bounds the packages merged and files parsed at a time,
+	// together. Values below 1 are treated as 1, which is the default.
+	Concurrency int
+
+	// TargetFileSize splits the root package into shards of at most this
+	// many bytes, named after the merged file: gen_1.go, gen_2.go and so on.
+	// Zero merges the root package into a single file.
+	TargetFileSize int64
+
+	// TargetFileLines splits the root package into shards of at most this
+	// many lines, on top of TargetFileSize. Zero sets no line budget.
+	TargetFileLines int
+
+	// Entities are the package names of the schema types, e.g. "user", which
+	// StrategyPerEntity groups the root files by. The Extension takes them
+	// from the graph. When empty, they are the directories of the base
+	// directory holding <name>.go and where.go, or <name>.go with where.go
+	// merged into it.
+	Entities []string
+
+	// GeneratedFiles are the files the generator wrote, relative to BaseDir
+	// and slash separated, e.g. "user/where.go". The Extension takes them
+	// from the graph. Only these files and those carrying the standard
+	// "Code generated ... DO NOT EDIT." marker are merged, every other file
+	// is hand-written and left alone.
+	GeneratedFiles []string
+
+	// MergeTests merges the _test.go files of every package into
+	// <name>_test.go, and those of its external test package into
+	// <name>_external_test.go. Test files are left alone otherwise.
+	MergeTests bool
+
+	// CacheDir holds merged files keyed by the hash of their inputs, so
+	// that unchanged packages are not merged again. Empty disables the cache.
+	CacheDir string
+
+	// DiffWriter receives a unified diff of every package merged during a
+	// dry run. Nil disables the diff.
+	DiffWriter io.Writer
 }
 
 // DefaultSquishingConfig returns a default configuration.
 func DefaultSquishingConfig() SquishingConfig {
 	return SquishingConfig{
-		BaseDir:        "src/ent/gen",
+		BaseDir:        "ent", // ent's default target directory
 		DryRun:         false,
 		VerboseLogging: false,
 		MaxFileSize:    100 * 1024 * 1024, // 100MB safety limit
+		Policy:         DefaultPolicy(),
+		ConflictPolicy: ConflictFail,
+		Concurrency:    1,
 	}
 }
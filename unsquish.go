@@ -0,0 +1,293 @@
+package entsquish
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Unsquish splits every merged file of dir back into the files it was
+// merged from, using the manifest written by the merge. Each restored file
+// gets its original header, imports and import names back.
+//
+// Declarations keep the names they have in the merged file, so those renamed
+// by ConflictRename stay renamed, and declarations dropped by
+// ConflictKeepFirst are not restored. Identical duplicates are restored in
+// every file that held one.
+//
+// Merged files that no longer exist are skipped and dropped from the
+// manifest, and reported in the returned error once the others are restored.
+func Unsquish(dir string) error {
+	manifest, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		return fmt.Errorf("%s has no %s, it was not squished", dir, ManifestFileName)
+	}
+
+	var missing []string
+	for len(manifest.Outputs) > 0 {
+		output := manifest.Outputs[len(manifest.Outputs)-1]
+		if name := missingFile(dir, output); name != "" {
+			missing = append(missing, name)
+		} else if err := unsquishOutput(dir, output); err != nil {
+			return fmt.Errorf("failed to unsquish %s: %w", filepath.Join(dir, output.Output), err)
+		}
+
+		manifest.removeOutput(output.Output)
+		if err := manifest.write(dir); err != nil {
+			return err
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("skipped %d merged files of %s that no longer exist: %s", len(missing), dir, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// missingFile returns the name of the first merged file of output that does
+// not exist in dir, or "" if they all do.
+func missingFile(dir string, output ManifestOutput) string {
+	for _, name := range output.mergedFiles() {
+		if _, err := os.Stat(filepath.Join(dir, name)); os.IsNotExist(err) {
+			return name
+		}
+	}
+	return ""
+}
+
+// unsquishOutput restores the original files of a single merged file, or of
+// the shards it was split into.
+func unsquishOutput(dir string, output ManifestOutput) error {
+	fm := NewFileMergerFromConfig(DefaultSquishingConfig())
+	fileSet := token.NewFileSet()
+
+	parts := output.Shards
+	if len(parts) == 0 {
+		parts = []ManifestShard{{Name: output.Output, SHA256: output.SHA256}}
+		for i := range output.Declarations {
+			parts[0].Declarations = append(parts[0].Declarations, i)
+		}
+	}
+
+	// Put the declarations of every part back in the order of the manifest
+	decls := make([]ast.Decl, len(output.Declarations))
+	references := make(map[*ast.Ident]packageReference)
+	declComments := make(map[ast.Decl][]*ast.CommentGroup)
+	var packageName string
+	var mergedFiles []string
+	for _, part := range parts {
+		file, err := parseMergedPart(fileSet, dir, output, part)
+		if err != nil {
+			if len(output.Shards) > 0 {
+				err = fmt.Errorf("%s: %w", part.Name, err)
+			}
+			return err
+		}
+		packageName = file.Name.Name
+		mergedFiles = append(mergedFiles, part.Name)
+
+		var partDecls []ast.Decl
+		for _, decl := range file.Decls {
+			if genDecl, ok := decl.(*ast.GenDecl); ok && genDecl.Tok == token.IMPORT {
+				continue
+			}
+			partDecls = append(partDecls, decl)
+		}
+		if len(partDecls) != len(part.Declarations) {
+			return fmt.Errorf("%s has %d declarations, the manifest lists %d", part.Name, len(partDecls), len(part.Declarations))
+		}
+		for i, decl := range partDecls {
+			index := part.Declarations[i]
+			if index < 0 || index >= len(decls) || decls[index] != nil {
+				return fmt.Errorf("%s: invalid declaration index %d in the manifest", part.Name, index)
+			}
+			decls[index] = decl
+		}
+
+		fileInfo := FileInfo{Path: filepath.Join(dir, part.Name), PackageName: packageName, AST: file, FileSet: fileSet}
+		for ident, reference := range fm.packageReferences(fileInfo, fm.checkFile(fileInfo)) {
+			references[ident] = reference
+		}
+		commentMap := ast.NewCommentMap(fileSet, file, file.Comments)
+		for _, decl := range partDecls {
+			declComments[decl] = commentMap.Filter(decl).Comments()
+		}
+	}
+	for i, decl := range decls {
+		if decl == nil {
+			return fmt.Errorf("declaration %s is missing from the merged files", output.Declarations[i].Name)
+		}
+	}
+
+	// Assign each declaration to the files it came from
+	fileDecls := make(map[string][]ast.Decl)
+	for i, origin := range output.Declarations {
+		for _, name := range append([]string{origin.File}, origin.Duplicates...) {
+			fileDecls[name] = append(fileDecls[name], decls[i])
+		}
+	}
+
+	// Floating comments are restored from the manifest, wherever the merge
+	// placed them
+	floating := make(map[string]int)
+	for _, source := range output.Files {
+		for _, comment := range source.Comments {
+			floating[comment]++
+		}
+	}
+	for _, decl := range decls {
+		var comments []*ast.CommentGroup
+		for _, group := range declComments[decl] {
+			if text := commentText(group); floating[text] > 0 {
+				floating[text]--
+				continue
+			}
+			comments = append(comments, group)
+		}
+		declComments[decl] = comments
+	}
+
+	var outputPaths []string
+	var contents [][]byte
+	for _, source := range output.Files {
+		content, err := renderSourceFile(fileSet, packageName, source, fileDecls[source.Name], declComments, references)
+		if err != nil {
+			return fmt.Errorf("failed to render %s: %w", source.Name, err)
+		}
+		outputPaths = append(outputPaths, filepath.Join(dir, source.Name))
+		contents = append(contents, content)
+	}
+
+	tx, err := newPackageTransaction(SquishablePackage{Path: dir, Files: mergedFiles}, outputPaths...)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(contents...)
+}
+
+// parseMergedPart parses a merged file or shard of output, after checking
+// that it is the file the manifest describes.
+func parseMergedPart(fileSet *token.FileSet, dir string, output ManifestOutput, part ManifestShard) (*ast.File, error) {
+	partPath := filepath.Join(dir, part.Name)
+
+	// The manifest only matches the merged file as it was written
+	content, err := os.ReadFile(partPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read merged file: %w", err)
+	}
+	if checksum(content) != part.SHA256 {
+		return nil, fmt.Errorf("checksum mismatch, the file was modified after squishing")
+	}
+
+	if output.Options.LineDirectives {
+		var origins []DeclarationOrigin
+		for _, index := range part.Declarations {
+			if index >= 0 && index < len(output.Declarations) {
+				origins = append(origins, output.Declarations[index])
+			}
+		}
+		content = stripLineDirectives(content, origins)
+	}
+
+	file, err := parser.ParseFile(fileSet, partPath, content, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse merged file: %w", err)
+	}
+	return file, nil
+}
+
+// renderSourceFile prints an original file from its manifest entry and the
+// merged declarations that came from it. Package references are renamed to
+// the import names of the original file.
+func renderSourceFile(fileSet *token.FileSet, packageName string, source SourceFile, decls []ast.Decl,
+	declComments map[ast.Decl][]*ast.CommentGroup, references map[*ast.Ident]packageReference) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(source.Preamble)
+	fmt.Fprintf(&buf, "package %s\n", packageName)
+
+	idents := make(map[string]string)
+	if len(source.Imports) > 0 {
+		buf.WriteString("\nimport (\n")
+		for i, imp := range source.Imports {
+			if i > 0 && imp.Group != source.Imports[i-1].Group {
+				buf.WriteString("\n")
+			}
+			buf.WriteString("\t")
+			if imp.Name != "" {
+				buf.WriteString(imp.Name + " ")
+			}
+			buf.WriteString(strconv.Quote(imp.Path) + "\n")
+			idents[strconv.Quote(imp.Path)] = imp.Ident
+		}
+		buf.WriteString(")\n")
+	}
+
+	for _, comment := range source.Comments {
+		buf.WriteString("\n" + comment + "\n")
+	}
+
+	for _, decl := range decls {
+		var renameErr error
+		ast.Inspect(decl, func(n ast.Node) bool {
+			ident, ok := n.(*ast.Ident)
+			if !ok {
+				return true
+			}
+			if reference, ok := references[ident]; ok {
+				name, imported := idents[reference.ImportPath]
+				if !imported || name == "" {
+					renameErr = fmt.Errorf("declaration refers to %s, which the file does not import", reference.ImportPath)
+					return false
+				}
+				ident.Name = name
+			}
+			return true
+		})
+		if renameErr != nil {
+			return nil, renameErr
+		}
+
+		buf.WriteString("\n")
+		node := &printer.CommentedNode{Node: decl, Comments: declComments[decl]}
+		if err := format.Node(&buf, fileSet, node); err != nil {
+			return nil, fmt.Errorf("failed to print declaration: %w", err)
+		}
+		buf.WriteString("\n")
+	}
+
+	content, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to format file: %w", err)
+	}
+	return content, nil
+}
+
+// commentText returns the text of a comment group as written, the way it
+// is recorded in SourceFile.Comments.
+func commentText(group *ast.CommentGroup) string {
+	var text []string
+	for _, comment := range group.List {
+		text = append(text, comment.Text)
+	}
+	return strings.Join(text, "\n")
+}
+
+// stripLineDirectives removes the //line directives the merge placed above
+// the declarations with the given origins.
+func stripLineDirectives(content []byte, origins []DeclarationOrigin) []byte {
+	for _, origin := range origins {
+		content = bytes.Replace(content, []byte("\n"+lineDirective(origin)), []byte("\n"), 1)
+	}
+	return content
+}
@@ -0,0 +1,132 @@
+package entsquish
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/types"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// VerifyError reports a merged package that picked up type errors it did
+// not have before the merge. The package is reverted when it is returned.
+type VerifyError struct {
+	// Package is the package directory
+	Package string
+
+	// Diagnostics are the new type errors, formatted as "position: message"
+	Diagnostics []string
+}
+
+// Error implements the error interface.
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("merged package %s has %d new type errors:\n\t%s",
+		e.Package, len(e.Diagnostics), strings.Join(e.Diagnostics, "\n\t"))
+}
+
+// packageDiagnostics type-checks the package in dir and returns its type
+// errors. The files of the current build context are checked along with
+// files, so that packages merged under a build constraint are covered too.
+// For test files, those are the files of their test package.
+// Imports, including the rest of the gen tree, are type-checked from source,
+// see sourceImporter.
+func (fm *FileMerger) packageDiagnostics(dir string, files []string, tests bool) ([]types.Error, error) {
+	buildPkg, err := build.Default.ImportDir(dir, 0)
+	var noGoErr *build.NoGoError
+	if err != nil && !errors.As(err, &noGoErr) {
+		return nil, fmt.Errorf("failed to load package %s: %w", dir, err)
+	}
+
+	companions := buildPkg.GoFiles
+	if tests {
+		companions = append(append([]string{}, buildPkg.GoFiles...), buildPkg.TestGoFiles...)
+		if len(files) > 0 && slices.Contains(buildPkg.XTestGoFiles, files[0]) {
+			companions = buildPkg.XTestGoFiles
+		}
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, name := range append(append([]string{}, companions...), files...) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	fileSet := fm.imports.fileSet
+	var astFiles []*ast.File
+	for _, name := range names {
+		astFile, err := parser.ParseFile(fileSet, filepath.Join(dir, name), nil, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse file %s: %w", name, err)
+		}
+		astFiles = append(astFiles, astFile)
+	}
+	if len(astFiles) == 0 {
+		return nil, nil
+	}
+
+	var diagnostics []types.Error
+	conf := types.Config{
+		Importer:    fm.imports.forCheck(),
+		FakeImportC: true,
+		Error: func(err error) {
+			if typeErr, ok := err.(types.Error); ok {
+				diagnostics = append(diagnostics, typeErr)
+			}
+		},
+	}
+	_, _ = conf.Check(astFiles[0].Name.Name, fileSet, astFiles, nil)
+
+	return diagnostics, nil
+}
+
+// verifyPackage type-checks a merged package and compares the result with
+// the diagnostics of the package before the merge. If the merge introduced
+// type errors, the transaction is rolled back and a *VerifyError returned.
+func (fm *FileMerger) verifyPackage(pkg SquishablePackage, tx *packageTransaction, baseline []types.Error) error {
+	var outputs []string
+	for _, outputPath := range tx.outputPaths {
+		outputs = append(outputs, filepath.Base(outputPath))
+	}
+	unlock := fm.locks.lockCheck(pkg.Path)
+	diagnostics, err := fm.packageDiagnostics(pkg.Path, outputs, pkg.Tests)
+	unlock()
+	if err == nil {
+		// Errors are matched by message, since positions move in the merge
+		known := make(map[string]int)
+		for _, diagnostic := range baseline {
+			known[diagnostic.Msg]++
+		}
+
+		verifyErr := &VerifyError{Package: pkg.Path}
+		for _, diagnostic := range diagnostics {
+			if known[diagnostic.Msg] > 0 {
+				known[diagnostic.Msg]--
+				continue
+			}
+			verifyErr.Diagnostics = append(verifyErr.Diagnostics, diagnostic.Error())
+		}
+		if len(verifyErr.Diagnostics) == 0 {
+			if fm.verboseLogging {
+				fm.logf("entsquish: verified package %s", pkg.Path)
+			}
+			return nil
+		}
+		err = verifyErr
+	}
+
+	if fm.verboseLogging {
+		fm.logf("entsquish: reverting package %s: %v", pkg.Path, err)
+	}
+	defer fm.locks.lockWrite(pkg.Path)()
+	if rollbackErr := tx.Rollback(); rollbackErr != nil {
+		return fmt.Errorf("%w (rollback failed: %v)", err, rollbackErr)
+	}
+	return err
+}